@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiStep = 15 * time.Second   // period of the counters samples of the time windows.
+const apiMaxWindow = 6 * time.Hour // samples kept for the time windows.
+
+// Counters changes during a step of the time windows (or during a window).
+// Like the history records, only the changed commands are kept, by name.
+type apiSample struct {
+	histRec
+	exit  uint64
+	ehist [len(ehist)]uint64
+}
+
+// Add the changes of a more recent step.
+func (s *apiSample) add(o *apiSample) {
+	s.histRec.add(&o.histRec)
+	s.exit += o.exit
+	for l := range s.ehist {
+		s.ehist[l] += o.ehist[l]
+	}
+}
+
+// Steps of the last apiMaxWindow and the counters at the end of the last one.
+type apiSamples struct {
+	ss     []*apiSample
+	lt     time.Time
+	lexec  uint64
+	lexit  uint64
+	lehist [len(ehist)]uint64
+	last   map[*cmdInfo]histCmd
+	mut    sync.Mutex
+	done   chan bool
+}
+
+// Changes of the counters since the end of the last step.
+// Assumes the samples and the global maps are locked.
+func (as *apiSamples) changes(now time.Time) (*apiSample, map[*cmdInfo]histCmd) {
+	s := &apiSample{histRec: histRec{start: as.lt, dur: now.Sub(as.lt), exec: delta(nbExecEv, as.lexec), cmds: map[string]*histCmd{}}, exit: delta(nbExitEv, as.lexit)}
+	for l := range ehist {
+		s.ehist[l] = delta(ehist[l], as.lehist[l])
+	}
+	ds, cur := cmdDeltas(as.last)
+	for _, d := range ds {
+		c := d.histCmd
+		s.cmds[d.cmd] = &c
+	}
+	return s, cur
+}
+
+// End the current step (the first call only records the counters).
+func (as *apiSamples) step() {
+	now := time.Now()
+	as.mut.Lock()
+	defer as.mut.Unlock()
+	mutInfos.Lock()
+	s, cur := as.changes(now)
+	as.lt, as.lexec, as.lexit, as.lehist, as.last = now, nbExecEv, nbExitEv, ehist, cur
+	mutInfos.Unlock()
+	if s.start.IsZero() {
+		return
+	}
+	as.ss = append(as.ss, s)
+	for len(as.ss) > 0 && now.Sub(as.ss[0].start) > apiMaxWindow+apiStep {
+		as.ss[0] = nil
+		as.ss = as.ss[1:]
+	}
+}
+
+// Sample the counters every apiStep until done is closed.
+func (as *apiSamples) run() {
+	t := time.NewTicker(apiStep)
+	defer t.Stop()
+	for {
+		as.step()
+		select {
+		case <-as.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Changes since the most recent step start at least w old (else the oldest one), nil before the first sample.
+func (as *apiSamples) since(w time.Duration) *apiSample {
+	now := time.Now()
+	as.mut.Lock()
+	defer as.mut.Unlock()
+	if as.lt.IsZero() {
+		return nil
+	}
+	from := now.Add(-w)
+	start := func(i int) time.Time {
+		if i < len(as.ss) {
+			return as.ss[i].start
+		}
+		return as.lt // Of the current step.
+	}
+	i := sort.Search(len(as.ss)+1, func(i int) bool { return start(i).After(from) })
+	if i > 0 {
+		i--
+	}
+	r := &apiSample{}
+	for _, s := range as.ss[i:] {
+		r.add(s)
+	}
+	mutInfos.Lock()
+	s, _ := as.changes(now)
+	mutInfos.Unlock()
+	r.add(s)
+	return r
+}
+
+// Query parameters of the API: sort, top and window.
+type apiQuery struct {
+	sc     int
+	top    int // 0: all.
+	window time.Duration
+}
+
+// Parse the query parameters, the sort criteria and the number of lines default to -s and -t.
+func parseAPIQuery(r *http.Request) (*apiQuery, error) {
+	v := r.URL.Query()
+	sc, err := querySort(r)
+	if err != nil {
+		return nil, err
+	}
+	q := &apiQuery{sc: sc, top: top}
+	if t := v.Get("top"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid top '%s' (0 for all).", t)
+		}
+		q.top = n
+	}
+	if w := v.Get("window"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid window '%s' (eg: 5m, 1h).", w)
+		}
+		if d > apiMaxWindow {
+			return nil, fmt.Errorf("Window '%s' too long (at most %s).", w, apiMaxWindow)
+		}
+		if q.sc > scTime {
+			return nil, fmt.Errorf("The time windows only have the count and time sort criteria.")
+		}
+		q.window = d
+	}
+	return q, nil
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// Commands list of a response.
+type apiCommands struct {
+	Date     time.Time     `json:"date"`
+	Start    time.Time     `json:"start"` // start of the counters (or of the time window).
+	Duration int64         `json:"duration_ns"`
+	Sort     string        `json:"sort"`
+	Cmds     []cmdSnapshot `json:"commands"`
+}
+
+// Counters changes of a time window as a snapshot (commands counters and histogram only).
+func windowSnapshot(s *apiSample) *snapshot {
+	hn, _ := os.Hostname()
+	ws := &snapshot{Hostname: hn, Date: s.start.Add(s.dur), Start: s.start, Duration: int64(s.dur), Exec: s.exec, Exit: s.exit, Cmds: []cmdSnapshot{}}
+	last := 0
+	for l, n := range s.ehist {
+		if n != 0 {
+			last = l + 1
+		}
+	}
+	ws.Hist = append([]uint64{}, s.ehist[:last]...)
+	mutInfos.Lock()
+	for cmd, c := range s.cmds {
+		cs := cmdSnapshot{Cmd: cmd, Exec: c.ec, Time: c.et, SubExec: c.subec}
+		if ci, known := cmdInfos[cmd]; known {
+			cs.SubHide = !subReportAccept(ci)
+		}
+		ws.Cmds = append(ws.Cmds, cs)
+	}
+	mutInfos.Unlock()
+	return ws
+}
+
+// Snapshot of the query: the current one, or the changes during its time window.
+func (ws *webServer) querySnapshot(q *apiQuery) *snapshot {
+	if q.window != 0 {
+		if s := ws.samples.since(q.window); s != nil {
+			return windowSnapshot(s)
+		}
+	}
+	return takeSnapshot()
+}
+
+// Sort (by the query criteria) and cut (to the query top) the commands of a snapshot.
+func (q *apiQuery) sortCmds(cs []cmdSnapshot, sub bool) []cmdSnapshot {
+	sort.SliceStable(cs, func(i, j int) bool {
+		a, b := snapshotKey(&cs[i], q.sc, sub), snapshotKey(&cs[j], q.sc, sub)
+		if a != b {
+			return a > b
+		}
+		return cs[i].Cmd < cs[j].Cmd
+	})
+	if q.top != 0 && len(cs) > q.top {
+		cs = cs[:q.top]
+	}
+	return cs
+}
+
+// GET /api/snapshot?sort=&top=&window=: the json output snapshot (all the commands unless top is given).
+func (ws *webServer) apiSnapshot(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAPIQuery(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if r.URL.Query().Get("top") == "" {
+		q.top = 0
+	}
+	s := ws.querySnapshot(q)
+	s.Cmds = q.sortCmds(s.Cmds, false)
+	writeJSON(w, s)
+}
+
+// GET /api/commands?sort=&top=&window=&sub=1: the top commands (by their subtree with sub=1).
+func (ws *webServer) apiCommands(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAPIQuery(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	sub := r.URL.Query().Get("sub") == "1"
+	s := ws.querySnapshot(q)
+	var cs []cmdSnapshot
+	for _, c := range s.Cmds {
+		if snapshotKey(&c, scCount, sub) != 0 || snapshotKey(&c, scTime, sub) != 0 {
+			c.Args, c.Ctx = nil, nil // In /api/commands/{name}.
+			cs = append(cs, c)
+		}
+	}
+	writeJSON(w, &apiCommands{Date: s.Date, Start: s.Start, Duration: s.Duration, Sort: sortKeys[q.sc], Cmds: q.sortCmds(cs, sub)})
+}
+
+// Ancestry tree children of a command (summed over all the tree nodes of the command).
+type apiChildren struct {
+	Cmd  string         `json:"cmd"`
+	Sort string         `json:"sort"`
+	Kids []treeSnapshot `json:"children"`
+}
+
+// /api/commands/{name} and /api/commands/{name}/children.
+func (ws *webServer) apiCommand(w http.ResponseWriter, r *http.Request) {
+	p := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/commands/"), "/")
+	name, err := url.PathUnescape(p[0])
+	if err != nil || len(p) > 2 || (len(p) == 2 && p[1] != "children") {
+		apiError(w, http.StatusNotFound, fmt.Errorf("Unknown endpoint %s.", r.URL.Path))
+		return
+	}
+	q, err := parseAPIQuery(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(p) == 2 {
+		ws.apiChildren(w, q, name)
+		return
+	}
+	s := ws.querySnapshot(q)
+	for _, c := range s.Cmds {
+		if c.Cmd == name {
+			writeJSON(w, c)
+			return
+		}
+	}
+	apiError(w, http.StatusNotFound, fmt.Errorf("Unknown command '%s'.", name))
+}
+
+func (ws *webServer) apiChildren(w http.ResponseWriter, q *apiQuery, name string) {
+	if !treeOn {
+		apiError(w, http.StatusNotFound, fmt.Errorf("The children of the commands need the ancestry tree (-A)."))
+		return
+	}
+	if q.window != 0 {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("The ancestry tree has no time windows."))
+		return
+	}
+	if q.sc > scTime {
+		q.sc = execSortCriteria()
+	}
+	mutInfos.Lock()
+	root := makeTreeSnapshot(treeRoot)
+	mutInfos.Unlock()
+	kids := map[string]*treeSnapshot{}
+	found := false
+	var walk func(t *treeSnapshot)
+	walk = func(t *treeSnapshot) {
+		for i := range t.Kids {
+			k := &t.Kids[i]
+			if k.Cmd == name {
+				found = true
+				for j := range k.Kids {
+					c := &k.Kids[j]
+					s, known := kids[c.Cmd]
+					if !known {
+						s = &treeSnapshot{Cmd: c.Cmd}
+						kids[c.Cmd] = s
+					}
+					s.Exec += c.Exec
+					s.Time += c.Time
+					s.CPU += c.CPU
+					s.SubExec += c.SubExec
+					s.SubTime += c.SubTime
+				}
+			}
+			walk(k)
+		}
+	}
+	walk(&root)
+	if !found {
+		apiError(w, http.StatusNotFound, fmt.Errorf("Unknown command '%s'.", name))
+		return
+	}
+	res := &apiChildren{Cmd: name, Sort: sortKeys[q.sc], Kids: []treeSnapshot{}}
+	for _, k := range kids {
+		res.Kids = append(res.Kids, *k)
+	}
+	key := func(t *treeSnapshot) uint64 {
+		if q.sc == scTime {
+			return t.Time + t.SubTime
+		}
+		return t.Exec + t.SubExec
+	}
+	sort.Slice(res.Kids, func(i, j int) bool { return key(&res.Kids[i]) > key(&res.Kids[j]) })
+	if q.top != 0 && len(res.Kids) > q.top {
+		res.Kids = res.Kids[:q.top]
+	}
+	writeJSON(w, res)
+}
+
+// GET /api/tree?top=&depth=: the ancestry tree, at most top children per node (by exec count of their subtree).
+func (ws *webServer) apiTree(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAPIQuery(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !treeOn {
+		apiError(w, http.StatusNotFound, fmt.Errorf("The ancestry tree needs -A."))
+		return
+	}
+	if q.window != 0 {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("The ancestry tree has no time windows."))
+		return
+	}
+	depth := 0
+	if d := r.URL.Query().Get("depth"); d != "" {
+		if depth, err = strconv.Atoi(d); err != nil || depth < 0 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("Invalid depth '%s' (0 for all).", d))
+			return
+		}
+	}
+	mutInfos.Lock()
+	root := makeTreeSnapshot(treeRoot)
+	mutInfos.Unlock()
+	var prune func(t *treeSnapshot, l int)
+	prune = func(t *treeSnapshot, l int) {
+		if depth != 0 && l >= depth {
+			t.Kids = nil
+			return
+		}
+		if q.top != 0 && len(t.Kids) > q.top {
+			t.Kids = t.Kids[:q.top]
+		}
+		for i := range t.Kids {
+			prune(&t.Kids[i], l+1)
+		}
+	}
+	prune(&root, 0)
+	writeJSON(w, root)
+}
+
+// Execution time histogram bucket of a response.
+type apiBucket struct {
+	Below int64  `json:"below_ns"`
+	Count uint64 `json:"count"`
+}
+
+// GET /api/histogram?window=&cmd=: the execution time histogram (of a command with cmd).
+func (ws *webServer) apiHistogram(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAPIQuery(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	cmd := r.URL.Query().Get("cmd")
+	if cmd != "" && q.window != 0 {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("The command histograms have no time windows."))
+		return
+	}
+	s := ws.querySnapshot(q)
+	h := s.Hist
+	if cmd != "" {
+		h = nil
+		found := false
+		for _, c := range s.Cmds {
+			if c.Cmd == cmd {
+				h, found = c.Hist, true
+			}
+		}
+		if !found {
+			apiError(w, http.StatusNotFound, fmt.Errorf("Unknown command '%s'.", cmd))
+			return
+		}
+	}
+	res := struct {
+		Date     time.Time   `json:"date"`
+		Start    time.Time   `json:"start"`
+		Duration int64       `json:"duration_ns"`
+		Cmd      string      `json:"cmd,omitempty"`
+		Buckets  []apiBucket `json:"buckets"`
+	}{Date: s.Date, Start: s.Start, Duration: s.Duration, Cmd: cmd, Buckets: []apiBucket{}}
+	p := int64(1)
+	for _, n := range h {
+		p *= 10
+		res.Buckets = append(res.Buckets, apiBucket{p, n})
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAPIQuery(t *testing.T) {
+	defer func(sc, t int, m bool) { sortCriteria, top, memOn = sc, t, m }(sortCriteria, top, memOn)
+	sortCriteria, top = scTime, 10
+	tests := []struct {
+		query string
+		mem   bool
+		want  apiQuery
+		err   string
+	}{
+		{"", false, apiQuery{sc: scTime, top: 10}, ""},
+		{"sort=count&top=5&window=5m", false, apiQuery{sc: scCount, top: 5, window: 5 * time.Minute}, ""},
+		{"top=0&window=6h", false, apiQuery{sc: scTime, window: apiMaxWindow}, ""},
+		{"sort=io", true, apiQuery{sc: scIO, top: 10}, ""},
+		{"sort=rss", false, apiQuery{}, "needs the memory and I/O sampling"},
+		{"sort=name", false, apiQuery{}, "Unknown sort criteria 'name'"},
+		{"top=-1", false, apiQuery{}, "Invalid top"},
+		{"top=all", false, apiQuery{}, "Invalid top"},
+		{"window=5", false, apiQuery{}, "Invalid window"},
+		{"window=-5m", false, apiQuery{}, "Invalid window"},
+		{"window=7h", false, apiQuery{}, "too long"},
+		{"window=5m&sort=faults", true, apiQuery{}, "only have the count and time sort criteria"},
+	}
+	for _, tt := range tests {
+		memOn = tt.mem
+		q, err := parseAPIQuery(httptest.NewRequest("GET", "/api/commands?"+tt.query, nil))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.query, err)
+			continue
+		}
+		if *q != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.query, *q, tt.want)
+		}
+	}
+}
+
+func TestAPISamplesSince(t *testing.T) {
+	if s := (&apiSamples{}).since(time.Minute); s != nil {
+		t.Errorf("got %+v before the first sample", s)
+	}
+	cmdInfos, procInfos = map[string]*cmdInfo{}, map[int]*procInfo{}
+	nbExecEv, nbExitEv, ehist = 100, 50, [len(ehist)]uint64{}
+	// Four steps and the current one started 5s ago, the current changes are 5 exec() of c.
+	now := time.Now()
+	as := &apiSamples{lt: now.Add(-5 * time.Second), lexec: 95, lexit: 50, last: map[*cmdInfo]histCmd{}}
+	cmdInfos["c"] = &cmdInfo{cmd: "c", ec: 5}
+	for i, n := range []uint64{1, 2, 4, 8} {
+		s := &apiSample{histRec: histRec{start: as.lt.Add(time.Duration(i-4) * apiStep), dur: apiStep, exec: n, cmds: map[string]*histCmd{"a": {ec: n}}}, exit: n}
+		s.ehist[1] = n
+		if i == 3 {
+			s.cmds["b"] = &histCmd{ec: 1, et: 1000}
+		}
+		as.ss = append(as.ss, s)
+	}
+	tests := []struct {
+		w     time.Duration
+		first int // of the summed steps.
+		exec  uint64
+		cmds  map[string]histCmd
+	}{
+		{time.Second, 4, 5, map[string]histCmd{"c": {ec: 5}}},
+		{10 * time.Second, 3, 13, map[string]histCmd{"a": {ec: 8}, "b": {ec: 1, et: 1000}, "c": {ec: 5}}},
+		{30 * time.Second, 2, 17, map[string]histCmd{"a": {ec: 12}, "b": {ec: 1, et: 1000}, "c": {ec: 5}}},
+		{apiMaxWindow, 0, 20, map[string]histCmd{"a": {ec: 15}, "b": {ec: 1, et: 1000}, "c": {ec: 5}}},
+	}
+	for _, tt := range tests {
+		s := as.since(tt.w)
+		start := as.lt
+		if tt.first < len(as.ss) {
+			start = as.ss[tt.first].start
+		}
+		if !s.start.Equal(start) || s.dur < time.Duration(len(as.ss)-tt.first)*apiStep+5*time.Second {
+			t.Errorf("%s: got start %s duration %s, want the start of step %d", tt.w, s.start, s.dur, tt.first)
+		}
+		if s.exec != tt.exec || s.exit != tt.exec-5 || s.ehist[1] != tt.exec-5 {
+			t.Errorf("%s: got exec %d exit %d histogram %v, want %d exec", tt.w, s.exec, s.exit, s.ehist, tt.exec)
+		}
+		cmds := map[string]histCmd{}
+		for c, h := range s.cmds {
+			cmds[c] = *h
+		}
+		if !reflect.DeepEqual(cmds, tt.cmds) {
+			t.Errorf("%s: got %v, want %v", tt.w, cmds, tt.cmds)
+		}
+	}
+}
+
+func TestAPISamplesStep(t *testing.T) {
+	cmdInfos, procInfos = map[string]*cmdInfo{}, map[int]*procInfo{}
+	nbExecEv, nbExitEv, ehist = 10, 0, [len(ehist)]uint64{}
+	ci := &cmdInfo{cmd: "a", ec: 10}
+	cmdInfos["a"] = ci
+	as := &apiSamples{}
+	as.step() // Only records the counters.
+	if len(as.ss) != 0 || as.lexec != 10 || as.last[ci].ec != 10 {
+		t.Fatalf("first step: got %d steps, exec %d", len(as.ss), as.lexec)
+	}
+	nbExecEv, ci.ec, ci.subec = 13, 13, 2
+	cmdInfos["b"] = &cmdInfo{cmd: "b"} // Unchanged, not in the step.
+	as.step()
+	if len(as.ss) != 1 {
+		t.Fatalf("got %d steps, want 1", len(as.ss))
+	}
+	if s := as.ss[0]; s.exec != 3 || len(s.cmds) != 1 || *s.cmds["a"] != (histCmd{ec: 3, subec: 2}) {
+		t.Errorf("got exec %d and %d commands", s.exec, len(s.cmds))
+	}
+}
+
+func TestWindowSnapshot(t *testing.T) {
+	cmdInfos, procInfos = map[string]*cmdInfo{}, map[int]*procInfo{}
+	cmdInfos["systemd"] = &cmdInfo{cmd: "systemd"}
+	start := time.Now().Add(-time.Minute)
+	s := &apiSample{histRec: histRec{start: start, dur: time.Minute, exec: 4, cmds: map[string]*histCmd{
+		"sh":      {ec: 3, et: 3000, subec: 1},
+		"systemd": {subec: 4},
+	}}, exit: 2}
+	s.ehist[1], s.ehist[2] = 1, 3
+	ws := windowSnapshot(s)
+	if !ws.Start.Equal(start) || !ws.Date.Equal(start.Add(time.Minute)) || ws.Duration != int64(time.Minute) {
+		t.Errorf("got start %s date %s duration %d", ws.Start, ws.Date, ws.Duration)
+	}
+	if ws.Exec != 4 || ws.Exit != 2 || !reflect.DeepEqual(ws.Hist, []uint64{0, 1, 3}) {
+		t.Errorf("got exec %d exit %d histogram %v", ws.Exec, ws.Exit, ws.Hist)
+	}
+	sort.Slice(ws.Cmds, func(i, j int) bool { return ws.Cmds[i].Cmd < ws.Cmds[j].Cmd })
+	want := []cmdSnapshot{{Cmd: "sh", Exec: 3, Time: 3000, SubExec: 1}, {Cmd: "systemd", SubExec: 4, SubHide: true}}
+	if !reflect.DeepEqual(ws.Cmds, want) {
+		t.Errorf("got %+v, want %+v", ws.Cmds, want)
+	}
+}
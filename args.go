@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var argsOn bool // -a: aggregate the commands by argument pattern.
+
+const argsMaxPatterns = 50 // per command, the next patterns are accounted as "<other>".
+const argsMaxSamples = 3   // full command lines kept per pattern.
+const argsMaxLen = 256     // patterns and samples are truncated to this length.
+
+var reNumber = regexp.MustCompile(`[0-9]+([.:][0-9]+)*`)
+
+// Exec count of an argument pattern of a command.
+type argInfo struct {
+	pattern string
+	ec      uint64
+	samples []string
+}
+
+// Replace the variable parts of an argument by placeholders.
+func normalizeArg(a string) string {
+	switch {
+	case a == "":
+		return a
+	case strings.ContainsAny(a, " \t\n"):
+		return "<str>" // Was a quoted string.
+	case strings.HasPrefix(a, "-") && strings.IndexByte(a, '=') > 0:
+		// --option=value
+		i := strings.IndexByte(a, '=')
+		return a[:i+1] + normalizeArg(a[i+1:])
+	case strings.IndexByte(a, '/') >= 0 || strings.HasPrefix(a, "~"):
+		return "<path>"
+	}
+	return reNumber.ReplaceAllString(a, "<n>")
+}
+
+// Normalized argument pattern (and full command line) of a command line read from /proc/[pid]/cmdline.
+func argPattern(cmd string, cl []byte) (string, string) {
+	args := strings.Split(strings.TrimRight(string(cl), "\x00"), "\x00")
+	p := cmd
+	for _, a := range args[1:] {
+		p += " " + normalizeArg(a)
+	}
+	// Quote the arguments that would be ambiguous in the full command line.
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n\"") {
+			args[i] = strconv.Quote(a)
+		}
+	}
+	full := strings.Join(args, " ")
+	if len(p) > argsMaxLen {
+		p = p[:argsMaxLen] + "..."
+	}
+	if len(full) > argsMaxLen {
+		full = full[:argsMaxLen] + "..."
+	}
+	return p, full
+}
+
+// Account the argument pattern of a new exec()ed process.
+// Assumes the global maps are locked.
+func recordArgs(pid int, ci *cmdInfo) {
+	cl, err := fastRead("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil || len(cl) == 0 {
+		return // Vanished (or a kernel thread).
+	}
+	p, full := argPattern(ci.cmd, cl)
+	if ci.args == nil {
+		ci.args = map[string]*argInfo{}
+	}
+	ai, known := ci.args[p]
+	if !known {
+		if len(ci.args) >= argsMaxPatterns {
+			p = ci.cmd + " <other>"
+			ai, known = ci.args[p]
+		}
+		if !known {
+			ai = &argInfo{pattern: p}
+			ci.args[p] = ai
+		}
+	}
+	ai.ec++
+	if len(ai.samples) < argsMaxSamples {
+		for _, s := range ai.samples {
+			if s == full {
+				return
+			}
+		}
+		ai.samples = append(ai.samples, full)
+	}
+}
+
+// Argument patterns of a command sorted by exec count.
+// Assumes the global maps are locked.
+func sortedArgs(ci *cmdInfo) []*argInfo {
+	var ais []*argInfo
+	for _, ai := range ci.args {
+		ais = append(ais, ai)
+	}
+	sort.Slice(ais, func(i, j int) bool {
+		if ais[i].ec != ais[j].ec {
+			return ais[i].ec > ais[j].ec
+		}
+		return ais[i].pattern < ais[j].pattern
+	})
+	return ais
+}
+
+// Display the argument patterns of the most exec()ed commands.
+func statsArgs() {
+	printSep(out, " top %d commands argument patterns ", top)
+	var cis []*cmdInfo
+	mutInfos.Lock()
+	defer mutInfos.Unlock()
+	for _, ci := range cmdInfos {
+		if len(ci.args) != 0 && reportAccept(ci) {
+			cis = append(cis, ci)
+		}
+	}
+	sort.Slice(cis, func(i, j int) bool { return cis[i].ec > cis[j].ec })
+	for i, ci := range cis {
+		if i >= top {
+			break
+		}
+		if !raw {
+			fmt.Fprintf(out, "%s: %d\n", ci.cmd, ci.ec)
+		}
+		for j, ai := range sortedArgs(ci) {
+			if j >= 5 {
+				break
+			}
+			pc := float32(ai.ec*100) / float32(ci.ec)
+			if raw {
+				fmt.Fprintf(out, "ap:%s:%s:%.2f:%d\n", ci.cmd, ai.pattern, pc, ai.ec)
+				continue
+			}
+			fmt.Fprintf(out, "  %.2f%% (%d) %s\n", pc, ai.ec, ai.pattern)
+			for _, s := range ai.samples {
+				fmt.Fprintf(out, "      eg: %s\n", s)
+			}
+		}
+	}
+}
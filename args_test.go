@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeArg(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"-v", "-v"},
+		{"status", "status"},
+		{"42", "<n>"},
+		{"1.5", "<n>"},
+		{"10.0.0.1:8080", "<n>"},
+		{"-n3", "-n<n>"},
+		{"eth0", "eth<n>"},
+		{"/etc/passwd", "<path>"},
+		{"./run.sh", "<path>"},
+		{"~user", "<path>"},
+		{"a b", "<str>"},
+		{"a\tb", "<str>"},
+		{"--timeout=30", "--timeout=<n>"},
+		{"--config=/etc/x.conf", "--config=<path>"},
+		{"--name=a b", "<str>"},
+		{"--opt=", "--opt="},
+	}
+	for _, tt := range tests {
+		if got := normalizeArg(tt.in); got != tt.want {
+			t.Errorf("normalizeArg(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestArgPattern(t *testing.T) {
+	long := strings.Repeat("x", argsMaxLen)
+	tests := []struct {
+		cmd, cl       string
+		pattern, full string
+	}{
+		{"ls", "ls\x00", "ls", "ls"},
+		{"ls", "/bin/ls\x00-l\x00/tmp\x00", "ls -l <path>", "/bin/ls -l /tmp"},
+		{"sleep", "sleep\x0010\x00", "sleep <n>", "sleep 10"},
+		{"sh", "sh\x00-c\x00echo \"hi\"\x00\x00x\x00", "sh -c <str>  x", `sh -c "echo \"hi\"" "" x`},
+		{"echo", "echo\x00" + long + "\x00", "echo " + long[:argsMaxLen-5] + "...", "echo " + long[:argsMaxLen-5] + "..."},
+	}
+	for _, tt := range tests {
+		p, full := argPattern(tt.cmd, []byte(tt.cl))
+		if p != tt.pattern || full != tt.full {
+			t.Errorf("argPattern(%q, %q) = %q, %q, want %q, %q", tt.cmd, tt.cl, p, full, tt.pattern, tt.full)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var confn string // configuration file name.
+
+// Flags set on the command line, they override the configuration file values.
+var cmdlineFlags = map[string]bool{}
+
+// Friendly configuration keys for the one letter flags. Any other key is the name of a flag.
+// In a [section] the key is prefixed with the section name and a '-'. eg: [statsd] addr → statsd-addr.
+var confKeys = map[string]string{
+	"output":   "o",
+	"sort":     "s",
+	"interval": "i",
+	"raw":      "r",
+	"format":   "f",
+	"clear":    "c",
+	"top":      "t",
+}
+
+// A configuration value (strings, integers, booleans, durations as strings or arrays of these).
+type confValue struct {
+	key  string
+	vals []string
+	arr  bool
+	line int
+}
+
+// Parse a configuration file written in a (small) subset of TOML.
+func parseConf(fn string) ([]confValue, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cvs []confValue
+	var section string
+	sc := bufio.NewScanner(f)
+	ln := 0
+	for sc.Scan() {
+		ln++
+		l := strings.TrimSpace(stripComment(sc.Text()))
+		if l == "" {
+			continue
+		}
+		if l[0] == '[' {
+			if l[len(l)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: invalid section '%s'", fn, ln, l)
+			}
+			section = strings.TrimSpace(l[1 : len(l)-1])
+			continue
+		}
+		i := strings.IndexByte(l, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", fn, ln)
+		}
+		cv := confValue{key: strings.TrimSpace(l[:i]), line: ln}
+		if section != "" {
+			cv.key = section + "-" + cv.key
+		}
+		v := strings.TrimSpace(l[i+1:])
+		if strings.HasPrefix(v, "[") {
+			// Arrays may span several lines.
+			for !strings.HasSuffix(v, "]") && sc.Scan() {
+				ln++
+				v += " " + strings.TrimSpace(stripComment(sc.Text()))
+			}
+			if !strings.HasSuffix(v, "]") {
+				return nil, fmt.Errorf("%s:%d: unterminated array", fn, cv.line)
+			}
+			cv.arr = true
+			for _, e := range splitArray(v[1 : len(v)-1]) {
+				s, err := confScalar(e)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %s", fn, cv.line, err)
+				}
+				cv.vals = append(cv.vals, s)
+			}
+		} else {
+			s, err := confScalar(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", fn, ln, err)
+			}
+			cv.vals = []string{s}
+		}
+		cvs = append(cvs, cv)
+	}
+	return cvs, sc.Err()
+}
+
+// Remove a trailing # comment (not inside a string).
+func stripComment(l string) string {
+	var q byte
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		switch {
+		case q != 0 && c == '\\' && q == '"':
+			i++
+		case q != 0 && c == q:
+			q = 0
+		case q == 0 && (c == '"' || c == '\''):
+			q = c
+		case q == 0 && c == '#':
+			return l[:i]
+		}
+	}
+	return l
+}
+
+// Split the content of an array on the commas outside of strings.
+func splitArray(s string) []string {
+	var es []string
+	var q byte
+	si := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case q != 0 && c == '\\' && q == '"':
+			i++
+		case q != 0 && c == q:
+			q = 0
+		case q == 0 && (c == '"' || c == '\''):
+			q = c
+		case q == 0 && c == ',':
+			es = append(es, strings.TrimSpace(s[si:i]))
+			si = i + 1
+		}
+	}
+	if e := strings.TrimSpace(s[si:]); e != "" { // A trailing comma is allowed.
+		es = append(es, e)
+	}
+	return es
+}
+
+// Convert a scalar value to the string expected by flag.Set.
+func confScalar(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, "\""):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || v[len(v)-1] != '\'' {
+			return "", fmt.Errorf("invalid literal string %s", v)
+		}
+		return v[1 : len(v)-1], nil
+	case v == "true" || v == "false":
+		return v, nil
+	}
+	if _, err := strconv.ParseInt(strings.Replace(v, "_", "", -1), 0, 64); err != nil {
+		return "", fmt.Errorf("invalid value %s (strings must be quoted)", v)
+	}
+	return strings.Replace(v, "_", "", -1), nil
+}
+
+// Flag values that need more than Set(DefValue) to get back to their default.
+type resetter interface {
+	reset()
+}
+
+// Apply the configuration file values to the flags not set on the command line.
+// Flags not set on the command line are first reset to their default so that a reload forgets the removed keys.
+func loadConf(fn string) error {
+	cvs, err := parseConf(fn)
+	if err != nil {
+		return err
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if cmdlineFlags[f.Name] {
+			return
+		}
+		if r, ok := f.Value.(resetter); ok {
+			r.reset()
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	for _, cv := range cvs {
+		fn := cv.key
+		if a, known := confKeys[fn]; known {
+			fn = a
+		}
+		f := flag.Lookup(fn)
+		if f == nil || fn == "C" {
+			return fmt.Errorf("%s:%d: unknown key '%s'", confn, cv.line, cv.key)
+		}
+		if cmdlineFlags[fn] {
+			continue
+		}
+		if _, ok := f.Value.(resetter); !ok && cv.arr {
+			return fmt.Errorf("%s:%d: '%s' is not a list", confn, cv.line, cv.key)
+		}
+		for _, v := range cv.vals {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("%s:%d: invalid value for '%s': %s", confn, cv.line, cv.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Values of the flags not set on the command line.
+func saveFlags() map[string]string {
+	vs := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !cmdlineFlags[f.Name] {
+			vs[f.Name] = f.Value.String()
+		}
+	})
+	return vs
+}
+
+// Set back the flags saved by saveFlags.
+func restoreFlags(vs map[string]string) {
+	for fn, v := range vs {
+		f := flag.Lookup(fn)
+		if r, ok := f.Value.(resetter); ok {
+			r.reset()
+		}
+		f.Value.Set(v) // Valid, but an empty pid list is an error (nothing to add).
+	}
+}
+
+// Reload the configuration file (SIGHUP), the counters are kept.
+func reloadConf() {
+	if confn == "" {
+		return
+	}
+	// Check the syntax first to keep the current configuration on a typo.
+	if _, err := parseConf(confn); err != nil {
+		logf(prioErr, "%s (configuration not reloaded)", err)
+		return
+	}
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+	mutInfos.Lock()
+	saved := saveFlags()
+	err := loadConf(confn)
+	if err == nil {
+		err = applyOpts()
+	}
+	mutInfos.Unlock()
+	if err == nil {
+		err = applyOutputs() // out.mut is taken before mutInfos by stats().
+	}
+	if err != nil {
+		// Back to the previous values (they were accepted).
+		logf(prioErr, "%s (configuration not reloaded)", err)
+		mutInfos.Lock()
+		restoreFlags(saved)
+		err = applyOpts()
+		mutInfos.Unlock()
+		if err == nil {
+			err = applyOutputs()
+		}
+		if err != nil {
+			logf(prioErr, "%s (previous configuration not fully restored)", err)
+		}
+		return
+	}
+	logf(prioInfo, "Configuration reloaded from %s.", confn)
+}
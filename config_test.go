@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConf(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want []confValue
+		err  string
+	}{
+		{"scalars", "top = 20\nsort = \"time\" # comment\nraw = true\n# only a comment\n\ninterval = '10s'\n", []confValue{
+			{key: "top", vals: []string{"20"}, line: 1},
+			{key: "sort", vals: []string{"time"}, line: 2},
+			{key: "raw", vals: []string{"true"}, line: 3},
+			{key: "interval", vals: []string{"10s"}, line: 6},
+		}, ""},
+		{"underscores", "top = 1_000\n", []confValue{{key: "top", vals: []string{"1000"}, line: 1}}, ""},
+		{"escapes", `output = "a \"#b\"\t"` + "\n", []confValue{{key: "output", vals: []string{"a \"#b\"\t"}, line: 1}}, ""},
+		{"section", "[statsd]\naddr = \"localhost:8125\"\n[ other ]\nx = 1\n", []confValue{
+			{key: "statsd-addr", vals: []string{"localhost:8125"}, line: 2},
+			{key: "other-x", vals: []string{"1"}, line: 4},
+		}, ""},
+		{"array", "hide = [\"cmd=init\", 'cmd~a,b', ]\n", []confValue{{key: "hide", vals: []string{"cmd=init", "cmd~a,b"}, arr: true, line: 1}}, ""},
+		{"multiline array", "hide = [\n  \"cmd=init\", # init\n  \"cmd=systemd\"\n]\ntop = 1\n", []confValue{
+			{key: "hide", vals: []string{"cmd=init", "cmd=systemd"}, arr: true, line: 1},
+			{key: "top", vals: []string{"1"}, line: 5},
+		}, ""},
+		{"empty array", "hide = []\n", []confValue{{key: "hide", arr: true, line: 1}}, ""},
+		{"bad section", "[statsd\n", nil, ":1: invalid section"},
+		{"no value", "top = 1\ntop\n", nil, ":2: expected key = value"},
+		{"no key", "= 1\n", nil, ":1: expected key = value"},
+		{"unquoted string", "sort = time\n", nil, ":1: invalid value time"},
+		{"bad literal", "sort = 'time\n", nil, ":1: invalid literal string"},
+		{"unterminated array", "top = 1\nhide = [\"a\",\n\"b\"\n", nil, ":2: unterminated array"},
+		{"bad array value", "hide = [a]\n", nil, ":1: invalid value a"},
+	}
+	fn := t.TempDir() + "/trexec.conf"
+	for _, tt := range tests {
+		if err := os.WriteFile(fn, []byte(tt.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cvs, err := parseConf(fn)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cvs, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, cvs, tt.want)
+		}
+	}
+}
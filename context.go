@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var cwdOn bool         // -cwd: keep the working directory of the commands.
+var envKeys stringList // -env: keep these environment variables of the commands.
+
+const ctxMaxSamples = 3 // distinct contexts kept per command.
+
+// Execution context of a command (working directory and some environment variables).
+type ctxInfo struct {
+	cwd string
+	env []string // KEY=value, in the -env order.
+	ec  uint64   // number of exec() with this context.
+}
+
+func (c *ctxInfo) String() string {
+	var s []string
+	if c.cwd != "" {
+		s = append(s, "cwd="+c.cwd)
+	}
+	for _, e := range c.env {
+		s = append(s, strconv.Quote(e))
+	}
+	return strings.Join(s, " ")
+}
+
+// Read the context of a new exec()ed process and keep it as an example for its command.
+// Assumes the global maps are locked.
+func recordContext(pid int, ci *cmdInfo) {
+	p := "/proc/" + strconv.Itoa(pid)
+	c := ctxInfo{}
+	if cwdOn {
+		c.cwd, _ = os.Readlink(p + "/cwd")
+	}
+	if len(envKeys) != 0 {
+		b, err := os.ReadFile(p + "/environ") // Often bigger than the fastRead buffer.
+		if err == nil {
+			for _, k := range envKeys {
+				if v, ok := envLookup(b, k); ok {
+					c.env = append(c.env, k+"="+v)
+				}
+			}
+		}
+	}
+	if c.cwd == "" && len(c.env) == 0 {
+		return
+	}
+	cs := c.String()
+	for _, oc := range ci.ctx {
+		if oc.String() == cs {
+			oc.ec++
+			return
+		}
+	}
+	if len(ci.ctx) < ctxMaxSamples {
+		c.ec = 1
+		ci.ctx = append(ci.ctx, &c)
+	}
+}
+
+// Find a variable in the content of /proc/[pid]/environ.
+func envLookup(env []byte, k string) (string, bool) {
+	kp := []byte(k + "=")
+	for _, e := range bytes.Split(env, []byte{0}) {
+		if bytes.HasPrefix(e, kp) {
+			return string(e[len(kp):]), true
+		}
+	}
+	return "", false
+}
+
+// Display the context examples of the most exec()ed commands.
+func statsContext() {
+	printSep(out, " top %d commands context ", top)
+	var cis []*cmdInfo
+	mutInfos.Lock()
+	defer mutInfos.Unlock()
+	for _, ci := range cmdInfos {
+		if len(ci.ctx) != 0 && reportAccept(ci) {
+			cis = append(cis, ci)
+		}
+	}
+	sort.Slice(cis, func(i, j int) bool { return cis[i].ec > cis[j].ec })
+	for i, ci := range cis {
+		if i >= top {
+			break
+		}
+		if !raw {
+			fmt.Fprintf(out, "%s: %d\n", ci.cmd, ci.ec)
+		}
+		for _, c := range ci.ctx {
+			if raw {
+				fmt.Fprintf(out, "cx:%s:%d:%s\n", ci.cmd, c.ec, c)
+			} else {
+				fmt.Fprintf(out, "  (%d) %s\n", c.ec, c)
+			}
+		}
+	}
+}
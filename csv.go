@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/csv"
+	"strconv"
+	"time"
+)
+
+// Columns of the csv output, the header row is written at the beginning of every output file.
+var csvHeader = []string{"date", "section", "cmd", "exec", "exec_pct", "exec_rate", "time_ns", "time_pct", "mean_time_ns", "pre_existing",
+	"procs", "rss_procs", "max_rss_kb", "sum_rss_kb", "minflt", "majflt", "read_bytes", "write_bytes", "cpu_ns"}
+
+// Output the commands and subtrees stats as csv rows (raw units: counts, nanoseconds, exec per second).
+// The section column is cmd for the commands and sub for the sums of their sub processes.
+func statsCSV() {
+	s := takeSnapshot()
+	w := csv.NewWriter(out)
+	if out.size == 0 {
+		w.Write(csvHeader)
+	}
+	date := s.Date.Format(time.RFC3339Nano)
+	u := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 4, 64) }
+	var set, sset uint64
+	for _, c := range s.Cmds {
+		set += c.Time
+		if !c.SubHide {
+			sset += c.SubTime
+		}
+	}
+	row := func(section, cmd string, ec, et, tt, pre uint64, r *resSnapshot) {
+		var mean string
+		if ec != 0 {
+			mean = u(et / ec)
+		}
+		var preS string
+		if section == "cmd" {
+			preS = u(pre)
+		}
+		rec := []string{date, section, cmd, u(ec), f(pct(ec, s.Exec)), f(s.rate(ec)), u(et), f(pct(et, tt)), mean, preS}
+		if r != nil {
+			rec = append(rec, u(r.Procs), u(r.RSSProcs), u(r.MaxRSS), u(r.RSS), u(r.MinFlt), u(r.MajFlt), u(r.Read), u(r.Write), u(r.CPU))
+		} else {
+			rec = append(rec, "", "", "", "", "", "", "", "", "")
+		}
+		w.Write(rec)
+	}
+	for _, c := range s.Cmds {
+		if c.Exec != 0 || c.Time != 0 {
+			row("cmd", c.Cmd, c.Exec, c.Time, set, c.Pre, c.Res)
+		}
+	}
+	for _, c := range s.Cmds {
+		if c.SubExec != 0 && !c.SubHide {
+			row("sub", c.Cmd, c.SubExec, c.SubTime, sset, 0, c.SubRes)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		logf(prioErr, "csv: %s", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsCSV(t *testing.T) {
+	f, err := os.Create(t.TempDir() + "/out.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(o *outFile) { out = o }(out)
+	out = &outFile{f: f}
+	cmdInfos, procInfos = map[string]*cmdInfo{}, map[int]*procInfo{}
+	nbExecEv, nbforkev, nbExitEv, nbDroppedEv, ehist = 4, 4, 0, 0, [len(ehist)]uint64{}
+	start = time.Now().Add(-2 * time.Second)
+	cmdInfos["sh"] = &cmdInfo{cmd: "sh", ec: 3, et: 3000, subec: 1, subet: 1000, pc: 1,
+		res: resUsage{n: 3, nrss: 3, rss: 300, maxrss: 200, minflt: 10, majflt: 1, rb: 4096, wb: 8192, cpu: 5000}}
+	cmdInfos["ls"] = &cmdInfo{cmd: "ls", ec: 1, et: 1000}
+	cmdInfos["systemd"] = &cmdInfo{cmd: "systemd", subec: 4, subet: 4000} // -hide-sub default.
+	statsCSV()
+	statsCSV() // The header is only written at the beginning of the file.
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 7 {
+		t.Fatalf("got %d records, want 7: %q", len(recs), recs)
+	}
+	if !reflect.DeepEqual(recs[0], csvHeader) {
+		t.Errorf("header: got %q, want %q", recs[0], csvHeader)
+	}
+	col := map[string]int{}
+	for i, c := range csvHeader {
+		col[c] = i
+	}
+	tests := []map[string]string{
+		{"section": "cmd", "cmd": "sh", "exec": "3", "exec_pct": "75.0000", "time_ns": "3000", "time_pct": "75.0000", "mean_time_ns": "1000", "pre_existing": "1",
+			"procs": "3", "rss_procs": "3", "max_rss_kb": "200", "sum_rss_kb": "300", "minflt": "10", "majflt": "1", "read_bytes": "4096", "write_bytes": "8192", "cpu_ns": "5000"},
+		{"section": "cmd", "cmd": "ls", "exec": "1", "exec_pct": "25.0000", "time_ns": "1000", "time_pct": "25.0000", "mean_time_ns": "1000", "pre_existing": "0",
+			"procs": "", "max_rss_kb": "", "cpu_ns": ""},
+		{"section": "sub", "cmd": "sh", "exec": "1", "exec_pct": "25.0000", "time_ns": "1000", "time_pct": "100.0000", "mean_time_ns": "1000", "pre_existing": ""},
+	}
+	for i, rec := range recs[1:] {
+		if len(rec) != len(csvHeader) {
+			t.Errorf("record %d: got %d columns, want %d", i+1, len(rec), len(csvHeader))
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, rec[col["date"]]); err != nil {
+			t.Errorf("record %d: %s", i+1, err)
+		}
+		for c, want := range tests[i%len(tests)] {
+			if got := rec[col[c]]; got != want {
+				t.Errorf("record %d %s: got %q, want %q", i+1, c, got, want)
+			}
+		}
+	}
+}
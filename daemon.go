@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var daemon bool  // run as a (systemd) service.
+var pidfn string // pid file name.
+var journal bool // log to the systemd journal (else stderr).
+var mutLog = sync.Mutex{}
+
+// syslog priorities.
+const (
+	prioErr     = 3
+	prioWarning = 4
+	prioNotice  = 5
+	prioInfo    = 6
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// Functions called before exiting (flush the outputs and exporters).
+var exitHooks []func()
+
+// Register a function to call before exiting.
+func atExit(f func()) {
+	exitHooks = append(exitHooks, f)
+}
+
+// Flush everything and exit.
+func shutdown(code int) {
+	sdNotify("STOPPING=1")
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	if pidfn != "" {
+		os.Remove(pidfn)
+	}
+	os.Exit(code)
+}
+
+// Setup the daemon mode (logging, pid file, watchdog).
+func startDaemon() {
+	if !daemon {
+		return
+	}
+	// Log to the journal when our stderr is not already connected to it.
+	if _, err := os.Stat(journalSocket); err == nil && os.Getenv("JOURNAL_STREAM") == "" {
+		journal = true
+	}
+	if pidfn != "" {
+		check(os.WriteFile(pidfn, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644))
+	}
+	if us, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && us > 0 {
+		if p := os.Getenv("WATCHDOG_PID"); p == "" || p == strconv.Itoa(os.Getpid()) {
+			go watchdog(time.Duration(us) * time.Microsecond / 2)
+		}
+	}
+}
+
+// Called once we listen to the kernel process events.
+func ready() {
+	if runArgs != nil {
+		go runAndTrace()
+	}
+	sdNotify("READY=1")
+	if daemon {
+		logf(prioInfo, "Listening to process events (pid %d).", os.Getpid())
+	}
+}
+
+// The tick loop answers the watchdog on this channel.
+var alivec = make(chan bool)
+
+// Keep the systemd watchdog happy, as long as the tick loop answers and the global maps can be locked (the event callbacks are not stuck).
+// A deadlock blocks us too: the missing pings get us restarted.
+func watchdog(i time.Duration) {
+	ticker := time.NewTicker(i)
+	for range ticker.C {
+		select {
+		case alivec <- true:
+		case <-time.After(i):
+			logf(prioWarning, "The tick loop is not responding.")
+			continue
+		}
+		mutInfos.Lock()
+		mutInfos.Unlock()
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// Send a state to systemd (see sd_notify(3)). No-op when not started by systemd with Type=notify.
+func sdNotify(state string) {
+	sn := os.Getenv("NOTIFY_SOCKET")
+	if sn == "" {
+		return
+	}
+	if sn[0] == '@' {
+		sn = "\x00" + sn[1:] // abstract socket
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sn, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	c.Write([]byte(state))
+	c.Close()
+}
+
+// Send a structured entry to the systemd journal (native protocol).
+func journalSend(fields map[string]string) error {
+	var b bytes.Buffer
+	for k, v := range fields {
+		if strings.IndexByte(v, '\n') < 0 {
+			fmt.Fprintf(&b, "%s=%s\n", k, v)
+		} else {
+			// Multi lines values are sent as binary data: key\n, 64 bits little endian size, data, \n.
+			b.WriteString(k)
+			b.WriteByte('\n')
+			binary.Write(&b, binary.LittleEndian, uint64(len(v)))
+			b.WriteString(v)
+			b.WriteByte('\n')
+		}
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(b.Bytes())
+	c.Close()
+	return err
+}
+
+// Log a message with a syslog priority.
+// In daemon mode the message goes to the journal or to stderr with a <priority> prefix (understood by journald), else to stderr.
+func logf(prio int, format string, a ...interface{}) {
+	m := strings.TrimRight(fmt.Sprintf(format, a...), "\n")
+	mutLog.Lock()
+	defer mutLog.Unlock()
+	switch {
+	case journal:
+		err := journalSend(map[string]string{
+			"MESSAGE":           m,
+			"PRIORITY":          strconv.Itoa(prio),
+			"SYSLOG_IDENTIFIER": path.Base(os.Args[0]),
+		})
+		if err == nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "<%d>%s\n", prio, m)
+	case daemon:
+		for _, l := range strings.Split(m, "\n") {
+			fmt.Fprintf(os.Stderr, "<%d>%s\n", prio, l)
+		}
+	case prio <= prioErr:
+		fmt.Fprintf(os.Stderr, "Error: %s\n", m)
+	default:
+		fmt.Fprintf(os.Stderr, "%s\n", m)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Difference of a command (or subtree) statistics between two snapshots.
+type cmdDiff struct {
+	Cmd        string  `json:"cmd"`
+	State      string  `json:"state,omitempty"` // new or disappeared.
+	ExecBefore uint64  `json:"exec_before"`
+	ExecAfter  uint64  `json:"exec_after"`
+	RateBefore float64 `json:"rate_before"`
+	RateAfter  float64 `json:"rate_after"`
+	TimeBefore uint64  `json:"time_ns_before"`
+	TimeAfter  uint64  `json:"time_ns_after"`
+	key        float64 // sort key: absolute change of the exec (or time) per second.
+}
+
+// Difference of an execution time histogram bucket.
+type histDiff struct {
+	Below     int64   `json:"below_ns"`
+	PctBefore float64 `json:"pct_before"`
+	PctAfter  float64 `json:"pct_after"`
+}
+
+// Difference between two snapshots.
+type snapshotDiff struct {
+	Before   *snapshot  `json:"-"`
+	After    *snapshot  `json:"-"`
+	Dates    [2]string  `json:"dates"`
+	Duration [2]int64   `json:"duration_ns"`
+	Exec     [2]uint64  `json:"exec"`
+	Rate     [2]float64 `json:"rate"`
+	Cmds     []cmdDiff  `json:"commands"`
+	Subs     []cmdDiff  `json:"subtrees"`
+	Hist     []histDiff `json:"histogram"`
+}
+
+// Compare the (sub) statistics of the commands of two snapshots.
+func diffCmds(a, b *snapshot, sub bool) []cmdDiff {
+	ds := map[string]*cmdDiff{}
+	get := func(c *cmdSnapshot) (uint64, uint64) {
+		if sub {
+			if c.SubHide {
+				return 0, 0
+			}
+			return c.SubExec, c.SubTime
+		}
+		return c.Exec, c.Time
+	}
+	// Like in the stats, the subtrees without sub processes are ignored.
+	skip := func(e, t uint64) bool { return e == 0 && (sub || t == 0) }
+	for i := range a.Cmds {
+		e, t := get(&a.Cmds[i])
+		if skip(e, t) {
+			continue
+		}
+		ds[a.Cmds[i].Cmd] = &cmdDiff{Cmd: a.Cmds[i].Cmd, State: "disappeared", ExecBefore: e, TimeBefore: t, RateBefore: a.rate(e)}
+	}
+	for i := range b.Cmds {
+		e, t := get(&b.Cmds[i])
+		if skip(e, t) {
+			continue
+		}
+		d, known := ds[b.Cmds[i].Cmd]
+		if known {
+			d.State = ""
+		} else {
+			d = &cmdDiff{Cmd: b.Cmds[i].Cmd, State: "new"}
+			ds[d.Cmd] = d
+		}
+		d.ExecAfter, d.TimeAfter, d.RateAfter = e, t, b.rate(e)
+	}
+	var r []cmdDiff
+	for _, d := range ds {
+		switch sortCriteria {
+		case scCount:
+			d.key = math.Abs(d.RateAfter - d.RateBefore)
+		case scTime:
+			d.key = math.Abs(b.rate(d.TimeAfter) - a.rate(d.TimeBefore))
+		}
+		r = append(r, *d)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].key != r[j].key {
+			return r[i].key > r[j].key
+		}
+		return r[i].Cmd < r[j].Cmd
+	})
+	return r
+}
+
+// Histogram buckets in percent of the exited processes.
+func histPct(s *snapshot, l int) []float64 {
+	var t uint64
+	for _, n := range s.Hist {
+		t += n
+	}
+	p := make([]float64, l)
+	for i := 0; i < len(s.Hist) && i < l; i++ {
+		if t != 0 {
+			p[i] = float64(100*s.Hist[i]) / float64(t)
+		}
+	}
+	return p
+}
+
+func diffSnapshots(a, b *snapshot) *snapshotDiff {
+	d := &snapshotDiff{Before: a, After: b}
+	d.Dates = [2]string{a.Date.Format(time.RFC3339), b.Date.Format(time.RFC3339)}
+	d.Duration = [2]int64{a.Duration, b.Duration}
+	d.Exec = [2]uint64{a.Exec, b.Exec}
+	d.Rate = [2]float64{a.rate(a.Exec), b.rate(b.Exec)}
+	d.Cmds = diffCmds(a, b, false)
+	d.Subs = diffCmds(a, b, true)
+	l := max(len(a.Hist), len(b.Hist))
+	pa, pb := histPct(a, l), histPct(b, l)
+	p := int64(1)
+	for i := 0; i < l; i++ {
+		p *= 10
+		if len(d.Hist) == 0 && pa[i] == 0 && pb[i] == 0 {
+			continue // Skip the leading empty buckets.
+		}
+		d.Hist = append(d.Hist, histDiff{Below: p, PctBefore: pa[i], PctAfter: pb[i]})
+	}
+	return d
+}
+
+// Relative change in percent (or new/gone).
+func pctChange(a, b float64) string {
+	switch {
+	case a == 0 && b == 0:
+		return "="
+	case a == 0:
+		return "new"
+	case b == 0:
+		return "gone"
+	}
+	return fmt.Sprintf("%+.2f%%", 100*(b-a)/a)
+}
+
+// Display the commands (or subtrees) differences.
+func printCmdDiffs(ds []cmdDiff, state string) {
+	i := 0
+	for _, d := range ds {
+		if state != "" && d.State != state {
+			continue
+		}
+		i++
+		if i > top {
+			return
+		}
+		fmt.Fprintf(out, "%s: %d -> %d (%+d) %.2f -> %.2fe/s (%s) %s -> %s\n", d.Cmd, d.ExecBefore, d.ExecAfter, int64(d.ExecAfter)-int64(d.ExecBefore),
+			d.RateBefore, d.RateAfter, pctChange(d.RateBefore, d.RateAfter), time.Duration(d.TimeBefore), time.Duration(d.TimeAfter))
+	}
+}
+
+// Display a snapshots difference in text.
+func printDiff(d *snapshotDiff) {
+	printSep(out, "")
+	fmt.Fprintf(out, "before:             %s %s (%s)\n", d.Before.Hostname, d.Dates[0], time.Duration(d.Duration[0]))
+	fmt.Fprintf(out, "after:              %s %s (%s)\n", d.After.Hostname, d.Dates[1], time.Duration(d.Duration[1]))
+	fmt.Fprintf(out, "total exec calls:   %d -> %d (%.2f -> %.2fe/s %s)\n", d.Exec[0], d.Exec[1], d.Rate[0], d.Rate[1], pctChange(d.Rate[0], d.Rate[1]))
+	printSep(out, " top %d commands changes sorted by %s ", top, scStrings[sortCriteria])
+	printCmdDiffs(d.Cmds, "")
+	printSep(out, " new commands ")
+	printCmdDiffs(d.Cmds, "new")
+	printSep(out, " disappeared commands ")
+	printCmdDiffs(d.Cmds, "disappeared")
+	if len(d.Hist) != 0 {
+		printSep(out, " command execution time histogram (before, after, change) ")
+		// All the cells have the same width (up to -100.0pt).
+		for _, r := range []func(h histDiff) string{
+			func(h histDiff) string { return "<" + time.Duration(h.Below).String() },
+			func(h histDiff) string { return fmt.Sprintf("%.2f%%", h.PctBefore) },
+			func(h histDiff) string { return fmt.Sprintf("%.2f%%", h.PctAfter) },
+			func(h histDiff) string { return fmt.Sprintf("%+.1fpt", h.PctAfter-h.PctBefore) },
+		} {
+			fmt.Fprintf(out, "|")
+			for _, h := range d.Hist {
+				fmt.Fprintf(out, "%8s |", r(h))
+			}
+			fmt.Fprintf(out, "\n")
+		}
+	}
+	printSep(out, " top %d subtrees changes sorted by sum of subprocesses %s ", top, scStrings[sortCriteria])
+	printCmdDiffs(d.Subs, "")
+	printSep(out, "")
+}
+
+// trexec diff: compare two snapshots.
+func diffMain(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [options] before.json after.json\n", path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nCompare two snapshots saved with -f json (the last snapshot of each file is used).\n")
+	}
+	js := fs.Bool("json", false, "output the differences in json.")
+	sk := fs.String("s", "count", "sort criteria (count or time).")
+	fs.IntVar(&top, "t", 10, "number of lines in the top sections.")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *sk != "count" && *sk != "time" {
+		check(fmt.Errorf("Unknown sort criteria '%s'. Use -s 'count' or 'time'.", *sk))
+	}
+	check(setSortCriteria(*sk))
+	a, err := readSnapshot(fs.Arg(0))
+	check(err)
+	b, err := readSnapshot(fs.Arg(1))
+	check(err)
+	d := diffSnapshots(a, b)
+	out = &outFile{f: os.Stdout}
+	if *js {
+		e := json.NewEncoder(out)
+		e.SetIndent("", "  ")
+		check(e.Encode(d))
+		return
+	}
+	printDiff(d)
+}
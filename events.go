@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var eventsFn string              // -events: write a record per exec and exit event in this file (- is stdout).
+var eventsFormat string          // -events-format: json or logfmt.
+var eventsSample int             // -events-sample: only keep 1 exec event out of N (and the exit event of the same process).
+var eventsFilters = filterList{} // -events-filter: only keep the exec events matching these filters.
+
+const eventsMaxAnc = 32 // ancestry chain length limit.
+
+// The event stream.
+type eventStream struct {
+	fn     string
+	f      *os.File
+	w      *bufio.Writer
+	logfmt bool
+	n      uint64 // exec events seen (for the sampling).
+	mut    sync.Mutex
+}
+
+var events *eventStream
+
+func init() {
+	atExit(func() {
+		if events != nil {
+			events.close()
+		}
+	})
+}
+
+// An exec or exit event record.
+type execEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Pid      int       `json:"pid"`
+	Ppid     int       `json:"ppid"`
+	Cmd      string    `json:"cmd"`
+	UID      int       `json:"uid"`
+	Ancestry []string  `json:"ancestry"`
+	PidNs    uint64    `json:"pidns,omitempty"`       // -ns
+	NsPid    int       `json:"nspid,omitempty"`       // -ns: pid in its own pid namespace.
+	Duration int64     `json:"duration_ns,omitempty"` // exit
+	Status   *int      `json:"exit_status,omitempty"` // exit (not killed by a signal)
+	Signal   int       `json:"signal,omitempty"`      // exit (killed by this signal)
+}
+
+// Open, switch or close the event stream (at startup and after a configuration reload).
+// Assumes the global maps are locked after a reload.
+func setEvents() error {
+	switch eventsFormat {
+	case "json", "logfmt":
+	default:
+		return fmt.Errorf("Unknown events format '%s'. Use -events-format 'json' or 'logfmt'.", eventsFormat)
+	}
+	if eventsSample < 1 {
+		return fmt.Errorf("Invalid events sampling %d (keep 1 event out of N >= 1).", eventsSample)
+	}
+	if events != nil && events.fn == eventsFn && !events.closed() {
+		events.logfmt = eventsFormat == "logfmt"
+		return nil
+	}
+	if events != nil {
+		events.close()
+		events = nil
+	}
+	if eventsFn == "" {
+		return nil
+	}
+	e := &eventStream{fn: eventsFn, logfmt: eventsFormat == "logfmt"}
+	if err := e.open(); err != nil {
+		return err
+	}
+	events = e
+	go e.flusher()
+	return nil
+}
+
+// Do not keep the events in the buffer for too long.
+func (e *eventStream) flusher() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for range t.C {
+		e.mut.Lock()
+		if e.f == nil {
+			e.mut.Unlock()
+			return // Closed.
+		}
+		e.w.Flush()
+		e.mut.Unlock()
+	}
+}
+
+func (e *eventStream) open() error {
+	e.f = os.Stdout
+	if e.fn != "-" {
+		f, err := os.OpenFile(e.fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		e.f = f
+	}
+	e.w = bufio.NewWriterSize(e.f, 64*1024)
+	return nil
+}
+
+func (e *eventStream) closeFile() {
+	e.w.Flush()
+	if e.f != os.Stdout {
+		e.f.Close()
+	}
+}
+
+func (e *eventStream) close() {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.f != nil {
+		e.closeFile()
+		e.f = nil
+	}
+}
+
+// Close and reopen the file (SIGHUP, after logrotate moved it).
+func (e *eventStream) reopen() {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.fn == "-" || e.f == nil {
+		return
+	}
+	e.closeFile()
+	if err := e.open(); err != nil {
+		logf(prioErr, "events: %s (no more events until the next reload)", err)
+		e.f = nil
+	}
+}
+
+func (e *eventStream) closed() bool {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.f == nil
+}
+
+// Command names of the ancestors of a process (parent first).
+// Assumes the global maps are locked.
+func ancestry(pi *procInfo) []string {
+	var anc []string
+	ppid := pi.ppid
+	for len(anc) < eventsMaxAnc && ppid > 0 {
+		ppi, known := procInfos[ppid]
+		if !known {
+			break
+		}
+		anc = append(anc, ppi.ci.cmd)
+		ppid = ppi.ppid
+	}
+	return anc
+}
+
+// Write an exec event, decide if this process events are kept.
+// Assumes the global maps are locked.
+func eventExec(pi *procInfo) {
+	if len(eventsFilters.fs) != 0 {
+		a := &procAttrs{pid: pi.pid, ppid: pi.ppid, cmd: pi.ci.cmd}
+		if !accept(a, &filterList{}, &eventsFilters) {
+			return
+		}
+	}
+	events.n++
+	if (events.n-1)%uint64(eventsSample) != 0 {
+		return
+	}
+	pi.ev = &execEvent{Event: "exec", Pid: pi.pid, Ppid: pi.ppid, Cmd: pi.ci.cmd, UID: -1, Ancestry: ancestry(pi)}
+	if nsOn && pi.ns.pidns != 0 {
+		pi.ev.PidNs, pi.ev.NsPid = pi.ns.pidns, pi.ns.nspid
+	}
+	if fi, err := os.Stat("/proc/" + strconv.Itoa(pi.pid)); err == nil {
+		pi.ev.UID = int(fi.Sys().(*syscall.Stat_t).Uid)
+	}
+	pi.ev.Time = time.Now()
+	events.write(pi.ev)
+}
+
+// Write the exit event of a process whose exec event was kept.
+// code is the wait status of the process.
+// Assumes the global maps are locked.
+func eventExit(pi *procInfo, et uint64, code int) {
+	ev := *pi.ev
+	ev.Time = time.Now()
+	ev.Event = "exit"
+	ev.Duration = int64(et)
+	ws := syscall.WaitStatus(code)
+	if ws.Signaled() {
+		ev.Signal = int(ws.Signal())
+	} else {
+		st := ws.ExitStatus()
+		ev.Status = &st
+	}
+	events.write(&ev)
+}
+
+// Quote a logfmt value if needed.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (e *eventStream) write(ev *execEvent) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.f == nil {
+		return // Closed.
+	}
+	if !e.logfmt {
+		b, _ := json.Marshal(ev)
+		e.w.Write(append(b, '\n'))
+		return
+	}
+	fmt.Fprintf(e.w, "time=%s event=%s pid=%d ppid=%d cmd=%s uid=%d ancestry=%s",
+		ev.Time.Format(time.RFC3339Nano), ev.Event, ev.Pid, ev.Ppid, logfmtValue(ev.Cmd), ev.UID, logfmtValue(strings.Join(ev.Ancestry, ",")))
+	if ev.PidNs != 0 {
+		fmt.Fprintf(e.w, " pidns=%s nspid=%d", nsName(ev.PidNs), ev.NsPid)
+	}
+	if ev.Event == "exit" {
+		fmt.Fprintf(e.w, " duration=%s", time.Duration(ev.Duration))
+		if ev.Status != nil {
+			fmt.Fprintf(e.w, " exit_status=%d", *ev.Status)
+		} else {
+			fmt.Fprintf(e.w, " signal=%d", ev.Signal)
+		}
+	}
+	e.w.WriteByte('\n')
+}
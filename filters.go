@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Filter keys.
+const (
+	fkCmd    = iota // command name (tcomm)
+	fkExe           // executable path (/proc/[pid]/exe)
+	fkUID           // owner uid
+	fkCgroup        // cgroup path (any hierarchy)
+	fkAnc           // command of any ancestor
+	fkPidNs         // pid namespace inode number (or host)
+	fkMntNs         // mount namespace inode number (or host)
+)
+
+var filterKeys = map[string]int{"cmd": fkCmd, "exe": fkExe, "uid": fkUID, "cgroup": fkCgroup, "anc": fkAnc, "pidns": fkPidNs, "mntns": fkMntNs}
+
+// A filter expression: key=value (exact match) or key~regexp.
+type filter struct {
+	expr string
+	key  int
+	val  string
+	re   *regexp.Regexp
+}
+
+// A list of filter expressions, usable as a repeatable flag.
+type filterList struct {
+	fs   []*filter
+	dflt bool   // fs still holds the default value (replaced by the first Set).
+	def  string // default value.
+}
+
+var excludeFilters, includeFilters filterList                // applied when we get the exec() event.
+var hideFilters, showFilters filterList                      // applied when we display stats.
+var subHideFilters = filterList{def: "cmd=init,cmd=systemd"} // applied when we display the subtrees stats.
+
+var nbDroppedEv uint64 // count exec events dropped by the collection filters.
+
+func init() {
+	// Every process is a sub process of init, no need to mess the subtrees stats with this one.
+	subHideFilters.reset()
+}
+
+// Parse a single filter expression.
+func parseFilter(e string) (*filter, error) {
+	i := strings.IndexAny(e, "=~")
+	if i <= 0 {
+		return nil, fmt.Errorf("Invalid filter '%s'. Use key=value or key~regexp.", e)
+	}
+	k, known := filterKeys[e[:i]]
+	if !known {
+		return nil, fmt.Errorf("Unknown filter key '%s' in '%s'. Use cmd, exe, uid, cgroup, anc, pidns or mntns.", e[:i], e)
+	}
+	f := &filter{expr: e, key: k, val: e[i+1:]}
+	if e[i] == '~' {
+		re, err := regexp.Compile(f.val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regexp in filter '%s': %s", e, err)
+		}
+		f.re = re
+	} else if k == fkUID {
+		if _, err := strconv.Atoi(f.val); err != nil {
+			// Not a number, try a user name.
+			u, err := user.Lookup(f.val)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid uid in filter '%s': %s", e, err)
+			}
+			f.val = u.Uid
+		}
+	} else if f.val == "host" {
+		// Our own namespaces.
+		switch k {
+		case fkPidNs:
+			f.val = strconv.FormatUint(selfNs.pidns, 10)
+		case fkMntNs:
+			f.val = strconv.FormatUint(selfNs.mntns, 10)
+		}
+	}
+	return f, nil
+}
+
+func (l *filterList) String() string {
+	if l == nil {
+		return ""
+	}
+	var es []string
+	for _, f := range l.fs {
+		es = append(es, f.expr)
+	}
+	return strings.Join(es, ",")
+}
+
+// Set adds comma separated filter expressions to the list.
+func (l *filterList) Set(v string) error {
+	if l.dflt {
+		l.fs = nil
+		l.dflt = false
+	}
+	for _, e := range strings.Split(v, ",") {
+		if e == "" {
+			continue
+		}
+		f, err := parseFilter(e)
+		if err != nil {
+			return err
+		}
+		l.fs = append(l.fs, f)
+	}
+	return nil
+}
+
+// Get back to the default value.
+func (l *filterList) reset() {
+	l.fs = nil
+	l.Set(l.def)
+	l.dflt = true
+}
+
+// Bitmask of the keys used by the list.
+func (l *filterList) needs() (n uint) {
+	for _, f := range l.fs {
+		n |= 1 << uint(f.key)
+	}
+	return n
+}
+
+// Process attributes used by the filters, read only when a filter needs them.
+type procAttrs struct {
+	pid    int
+	ppid   int
+	cmd    string
+	exe    string
+	uid    string
+	cgroup []string
+	anc    []string
+	pidns  string
+	mntns  string
+	got    uint // bitmask of the attributes already read.
+}
+
+// Read the attributes for the given keys bitmask.
+// Assumes the global maps are locked (climbs procInfos for ancestors).
+func (a *procAttrs) read(n uint) {
+	n &^= a.got
+	a.got |= n
+	p := "/proc/" + strconv.Itoa(a.pid)
+	if n&(1<<fkExe) != 0 {
+		a.exe, _ = os.Readlink(p + "/exe")
+	}
+	if n&(1<<fkUID) != 0 {
+		if fi, err := os.Stat(p); err == nil {
+			a.uid = strconv.Itoa(int(fi.Sys().(*syscall.Stat_t).Uid))
+		}
+	}
+	if n&(1<<fkCgroup) != 0 {
+		if s, err := fastRead(p + "/cgroup"); err == nil {
+			// Lines are hierarchy-ID:controller-list:cgroup-path
+			for _, l := range strings.Split(string(s), "\n") {
+				if i := strings.LastIndexByte(l, ':'); i >= 0 {
+					a.cgroup = append(a.cgroup, l[i+1:])
+				}
+			}
+		}
+	}
+	if n&(1<<fkPidNs|1<<fkMntNs) != 0 {
+		ns := readNs(a.pid)
+		if ns.pidns != 0 {
+			a.pidns = strconv.FormatUint(ns.pidns, 10)
+			a.mntns = strconv.FormatUint(ns.mntns, 10)
+		}
+		a.got |= 1<<fkPidNs | 1<<fkMntNs
+	}
+	if n&(1<<fkAnc) != 0 {
+		for ppid := a.ppid; ppid > 0 && len(a.anc) < 256; {
+			ppi, known := procInfos[ppid]
+			if !known {
+				break
+			}
+			a.anc = append(a.anc, ppi.ci.cmd)
+			ppid = ppi.ppid
+		}
+	}
+}
+
+func (f *filter) matchString(s string) bool {
+	if f.re != nil {
+		return f.re.MatchString(s)
+	}
+	return s == f.val
+}
+
+func (f *filter) matchAny(ss []string) bool {
+	for _, s := range ss {
+		if f.matchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filter) match(a *procAttrs) bool {
+	a.read(1 << uint(f.key))
+	switch f.key {
+	case fkCmd:
+		return f.matchString(a.cmd)
+	case fkExe:
+		return a.exe != "" && f.matchString(a.exe)
+	case fkUID:
+		return a.uid != "" && f.matchString(a.uid)
+	case fkCgroup:
+		return f.matchAny(a.cgroup)
+	case fkAnc:
+		return f.matchAny(a.anc)
+	case fkPidNs:
+		return a.pidns != "" && f.matchString(a.pidns)
+	case fkMntNs:
+		return a.mntns != "" && f.matchString(a.mntns)
+	}
+	return false
+}
+
+// True if any filter of the list matches.
+func (l *filterList) match(a *procAttrs) bool {
+	for _, f := range l.fs {
+		if f.match(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply an exclude and an include list.
+func accept(a *procAttrs, excl, incl *filterList) bool {
+	if excl.match(a) {
+		return false
+	}
+	return len(incl.fs) == 0 || incl.match(a)
+}
+
+// Apply the collection filters to a new exec()ed process.
+// The attributes needed by the report filters are kept in the command info (last instance seen).
+// Assumes the global maps are locked.
+func collectAccept(pid, ppid int, cmd string, ci *cmdInfo) bool {
+	if len(rootPids) != 0 && !underRoots(pid, ppid) {
+		return false
+	}
+	rn := hideFilters.needs() | showFilters.needs() | subHideFilters.needs() | extraNeeds
+	if len(excludeFilters.fs) == 0 && len(includeFilters.fs) == 0 && rn&^(1<<fkCmd) == 0 {
+		return true // Fast path, nothing to check.
+	}
+	a := &procAttrs{pid: pid, ppid: ppid, cmd: cmd}
+	if !accept(a, &excludeFilters, &includeFilters) {
+		return false
+	}
+	if rn&^(1<<fkCmd) != 0 {
+		a.read(rn)
+		ci.attrs = a
+	}
+	return true
+}
+
+// Attributes of a command for the report filters.
+func reportAttrs(ci *cmdInfo) *procAttrs {
+	a := ci.attrs
+	if a == nil {
+		a = &procAttrs{}
+	}
+	ra := *a
+	ra.cmd = ci.cmd
+	ra.got = ^uint(0) // Never read /proc at report time, the process is probably gone.
+	return &ra
+}
+
+// Apply the report filters to a command.
+func reportAccept(ci *cmdInfo) bool {
+	return accept(reportAttrs(ci), &hideFilters, &showFilters)
+}
+
+// Apply the report filters and -hide-sub to the subtree of a command.
+func subReportAccept(ci *cmdInfo) bool {
+	a := reportAttrs(ci)
+	return accept(a, &hideFilters, &showFilters) && !subHideFilters.match(a)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		key  int
+		val  string
+		re   bool
+		err  string
+	}{
+		{"cmd=bash", fkCmd, "bash", false, ""},
+		{"cmd=a=b", fkCmd, "a=b", false, ""},
+		{"exe~^/usr/bin/", fkExe, "^/usr/bin/", true, ""},
+		{"uid=1000", fkUID, "1000", false, ""},
+		{"uid=root", fkUID, "0", false, ""},
+		{"uid~^10", fkUID, "^10", true, ""},
+		{"cgroup~docker", fkCgroup, "docker", true, ""},
+		{"anc=sshd", fkAnc, "sshd", false, ""},
+		{"cmd", 0, "", false, "Invalid filter"},
+		{"=bash", 0, "", false, "Invalid filter"},
+		{"foo=bar", 0, "", false, "Unknown filter key 'foo'"},
+		{"cmd~(", 0, "", false, "Invalid regexp"},
+		{"uid=no such user", 0, "", false, "Invalid uid"},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.expr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.expr, err)
+			continue
+		}
+		if f.key != tt.key || f.val != tt.val || (f.re != nil) != tt.re || f.expr != tt.expr {
+			t.Errorf("%s: got key %d val %q regexp %v, want key %d val %q regexp %v", tt.expr, f.key, f.val, f.re != nil, tt.key, tt.val, tt.re)
+		}
+	}
+}
+
+func TestFilterList(t *testing.T) {
+	var l filterList
+	l.Set("cmd=init,cmd=systemd")
+	l.dflt = true
+	if err := l.Set("cmd~^ba,anc=sshd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("exe=/bin/sh"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l.String(), "cmd~^ba,anc=sshd,exe=/bin/sh"; got != want {
+		t.Errorf("got %q, want %q (the first Set replaces the default)", got, want)
+	}
+	if got, want := l.needs(), uint(1<<fkCmd|1<<fkAnc|1<<fkExe); got != want {
+		t.Errorf("needs: got %b, want %b", got, want)
+	}
+	tests := []struct {
+		a    procAttrs
+		want bool
+	}{
+		{procAttrs{cmd: "bash"}, true},
+		{procAttrs{cmd: "sh"}, false},
+		{procAttrs{cmd: "sh", exe: "/bin/sh"}, true},
+		{procAttrs{cmd: "sh", anc: []string{"cron", "sshd"}}, true},
+		{procAttrs{cmd: "sh", anc: []string{"sshd-session"}}, false},
+	}
+	for _, tt := range tests {
+		tt.a.got = ^uint(0)
+		if got := l.match(&tt.a); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestReportAccept(t *testing.T) {
+	defer func(h, s, sh filterList) { hideFilters, showFilters, subHideFilters = h, s, sh }(hideFilters, showFilters, subHideFilters)
+	hideFilters, showFilters = filterList{}, filterList{}
+	hideFilters.Set("cmd=cron")
+	tests := []struct {
+		cmd       string
+		show, sub bool
+	}{
+		{"bash", true, true},
+		{"cron", false, false},
+		{"init", true, false},
+		{"systemd", true, false},
+	}
+	for _, tt := range tests {
+		ci := &cmdInfo{cmd: tt.cmd}
+		if got := reportAccept(ci); got != tt.show {
+			t.Errorf("reportAccept(%s) = %v, want %v", tt.cmd, got, tt.show)
+		}
+		if got := subReportAccept(ci); got != tt.sub {
+			t.Errorf("subReportAccept(%s) = %v, want %v", tt.cmd, got, tt.sub)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var historyDir string         // -H: directory of the history store (none by default).
+var historyStep time.Duration // -history-step: interval between two samples of the history store.
+
+// The tick loop gets the (new) history step from here (0: no history).
+var historyc = make(chan time.Duration, 1)
+
+const histMagic = "trexec history 1\n"
+const histMaxCmds = 200 // per record, the next commands are accounted as "(other)".
+
+// Resolution levels of the history store.
+// Every level aggregates factor records of the previous one and keeps its last keep records.
+// With the default 1m step: 1m for a day, 10m for a week and 1h for 3 months.
+var histLevels = []struct {
+	factor int
+	keep   int
+}{
+	{1, 24 * 60},
+	{10, 7 * 24 * 6},
+	{6, 92 * 24},
+}
+
+// Counters of a command in a history record.
+type histCmd struct {
+	ec    uint64 // number of exec().
+	et    uint64 // execution time (ns, stored in µs).
+	subec uint64 // number of exec() of the sub processes.
+}
+
+// A record of the history store: the counters accumulated during dur.
+type histRec struct {
+	start time.Time
+	dur   time.Duration
+	exec  uint64
+	cmds  map[string]*histCmd
+}
+
+// Add the counters of a more recent record.
+func (r *histRec) add(o *histRec) {
+	if r.cmds == nil {
+		r.start = o.start
+		r.cmds = map[string]*histCmd{}
+	}
+	r.dur = o.start.Add(o.dur).Sub(r.start)
+	r.exec += o.exec
+	for c, oh := range o.cmds {
+		h, known := r.cmds[c]
+		if !known {
+			h = &histCmd{}
+			r.cmds[c] = h
+		}
+		h.ec += oh.ec
+		h.et += oh.et
+		h.subec += oh.subec
+	}
+}
+
+// A file of the history store (one per resolution level).
+// It is a sequence of records, every one is a type byte, a length and a payload made of varints:
+//
+//	'n' defines the id of a command name: id, name.
+//	'r' is a record: start (unix s), duration (ms), exec count, number of commands then id, ec, et (µs), subec for every command.
+type histFile struct {
+	fn      string
+	f       *bufio.Writer
+	fd      *os.File
+	ids     map[string]uint64 // command name ids defined in this file.
+	nrec    int               // number of records in the file.
+	pending histRec           // aggregation of the records of the previous level.
+	npend   int
+}
+
+// The history store.
+type histStore struct {
+	dir   string
+	files []*histFile
+	last  map[*cmdInfo]histCmd // counters at the last sample.
+	lexec uint64
+	lt    time.Time
+	mut   sync.Mutex
+}
+
+var history *histStore
+
+func init() {
+	atExit(func() {
+		if history != nil {
+			history.stop(true)
+		}
+	})
+}
+
+// Name of the file of a resolution level.
+func histFileName(dir string, level int) string {
+	return filepath.Join(dir, fmt.Sprintf("trexec.h%d", level))
+}
+
+// Open (or create) the history store in a directory.
+func openHistory(dir string) (*histStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &histStore{dir: dir, last: map[*cmdInfo]histCmd{}, lt: time.Now()}
+	for l := range histLevels {
+		hf := &histFile{fn: histFileName(dir, l)}
+		if err := hf.open(); err != nil {
+			h.close()
+			return nil, err
+		}
+		h.files = append(h.files, hf)
+	}
+	return h, nil
+}
+
+// Open a file of the store for appending, learn its command ids and number of records.
+func (hf *histFile) open() error {
+	hf.ids = map[string]uint64{}
+	hf.nrec = 0
+	size, err := readHistFile(hf.fn, func(r *histRec) { hf.nrec++ }, func(id uint64, name string) { hf.ids[name] = id })
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fd, err := os.OpenFile(hf.fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// Cut a record truncated by a crash, the next ones would be unreadable after it.
+	if fi, err := fd.Stat(); err == nil && fi.Size() > size {
+		if err := fd.Truncate(size); err != nil {
+			fd.Close()
+			return err
+		}
+	}
+	if size == 0 {
+		fd.WriteString(histMagic)
+	}
+	hf.fd, hf.f = fd, bufio.NewWriter(fd)
+	return nil
+}
+
+func (hf *histFile) close() {
+	if hf.fd != nil {
+		hf.f.Flush()
+		hf.fd.Close()
+		hf.fd = nil
+	}
+}
+
+// Write a typed chunk.
+func (hf *histFile) chunk(t byte, b []byte) {
+	hf.f.WriteByte(t)
+	var l [binary.MaxVarintLen64]byte
+	hf.f.Write(l[:binary.PutUvarint(l[:], uint64(len(b)))])
+	hf.f.Write(b)
+}
+
+// Append a record.
+func (hf *histFile) write(r *histRec) error {
+	var b []byte
+	uv := func(v uint64) { b = binary.AppendUvarint(b, v) }
+	cmds := make([]string, 0, len(r.cmds))
+	for c := range r.cmds {
+		cmds = append(cmds, c)
+	}
+	sort.Strings(cmds)
+	for _, c := range cmds {
+		if _, known := hf.ids[c]; !known {
+			id := uint64(len(hf.ids))
+			hf.ids[c] = id
+			b = b[:0]
+			uv(id)
+			b = append(b, c...)
+			hf.chunk('n', b)
+		}
+	}
+	b = b[:0]
+	b = binary.AppendVarint(b, r.start.Unix())
+	uv(uint64(r.dur / time.Millisecond))
+	uv(r.exec)
+	uv(uint64(len(cmds)))
+	for _, c := range cmds {
+		h := r.cmds[c]
+		uv(hf.ids[c])
+		uv(h.ec)
+		uv(h.et / 1000)
+		uv(h.subec)
+	}
+	hf.chunk('r', b)
+	hf.nrec++
+	return hf.f.Flush()
+}
+
+// Rewrite a file with only its last keep records.
+func (hf *histFile) compact(keep int) error {
+	var recs []*histRec
+	_, err := readHistFile(hf.fn, func(r *histRec) {
+		recs = append(recs, r)
+		if len(recs) > keep {
+			recs = recs[1:]
+		}
+	}, nil)
+	if err != nil {
+		return err
+	}
+	hf.close()
+	tmp := hf.fn + ".tmp"
+	os.Remove(tmp)
+	nf := &histFile{fn: tmp}
+	if err := nf.open(); err != nil {
+		return err
+	}
+	for _, r := range recs {
+		nf.write(r)
+	}
+	nf.close()
+	if err := os.Rename(tmp, hf.fn); err != nil {
+		return err
+	}
+	return hf.open()
+}
+
+// Append a record to a level, then aggregate it in the next levels.
+func (h *histStore) add(l int, r *histRec) error {
+	hf := h.files[l]
+	if err := hf.write(r); err != nil {
+		return err
+	}
+	if hf.nrec > 2*histLevels[l].keep {
+		if err := hf.compact(histLevels[l].keep); err != nil {
+			return err
+		}
+	}
+	if l+1 >= len(h.files) {
+		return nil
+	}
+	nf := h.files[l+1]
+	nf.pending.add(r)
+	nf.npend++
+	if nf.npend >= histLevels[l+1].factor {
+		return h.flushLevel(l + 1)
+	}
+	return nil
+}
+
+// Write the pending aggregation of a level.
+func (h *histStore) flushLevel(l int) error {
+	hf := h.files[l]
+	if hf.npend == 0 {
+		return nil
+	}
+	r := hf.pending
+	hf.pending, hf.npend = histRec{}, 0
+	return h.add(l, &r)
+}
+
+// Counters changes of a command.
+type cmdDelta struct {
+	ci  *cmdInfo
+	cmd string // (vanished) for the unknown commands.
+	histCmd
+}
+
+// Per command counters changes since a previous sample (only the commands accepted by the report filters).
+// Returns the non zero changes and the current counters (the next previous sample).
+// The counters cleared since the previous sample restart from 0 (the cmdInfos are new).
+// Assumes the global maps are locked.
+func cmdDeltas(last map[*cmdInfo]histCmd) ([]*cmdDelta, map[*cmdInfo]histCmd) {
+	var ds []*cmdDelta
+	cur := map[*cmdInfo]histCmd{}
+	for _, ci := range cmdInfos {
+		if !reportAccept(ci) {
+			continue
+		}
+		c := histCmd{ec: ci.ec, et: ci.et, subec: ci.subec}
+		cur[ci] = c
+		if l, known := last[ci]; known {
+			c.ec -= l.ec
+			c.et -= l.et
+			c.subec -= l.subec
+		}
+		if c.ec == 0 && c.et == 0 && c.subec == 0 {
+			continue
+		}
+		cmd := ci.cmd
+		if cmd == "" {
+			cmd = "(vanished)"
+		}
+		ds = append(ds, &cmdDelta{ci, cmd, c})
+	}
+	return ds, cur
+}
+
+// Record the counters accumulated since the last sample.
+func (h *histStore) sample() {
+	now := time.Now()
+	r := &histRec{start: h.lt, dur: now.Sub(h.lt), cmds: map[string]*histCmd{}}
+	mutInfos.Lock()
+	// The counters may have been cleared since the last sample (they then restart from 0).
+	r.exec = nbExecEv
+	if nbExecEv >= h.lexec {
+		r.exec -= h.lexec
+	}
+	h.lexec = nbExecEv
+	var ds []*cmdDelta
+	ds, h.last = cmdDeltas(h.last)
+	mutInfos.Unlock()
+	h.lt = now
+	var names []string
+	for _, d := range ds {
+		c := d.histCmd
+		r.cmds[d.cmd] = &c
+		names = append(names, d.cmd)
+	}
+	if len(r.cmds) > histMaxCmds {
+		sort.Slice(names, func(i, j int) bool { return r.cmds[names[i]].ec > r.cmds[names[j]].ec })
+		o := &histCmd{}
+		for _, n := range names[histMaxCmds:] {
+			c := r.cmds[n]
+			o.ec += c.ec
+			o.et += c.et
+			o.subec += c.subec
+			delete(r.cmds, n)
+		}
+		r.cmds["(other)"] = o
+	}
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if h.files == nil {
+		return // Closed.
+	}
+	if err := h.add(0, r); err != nil {
+		logf(prioErr, "history: %s", err)
+	}
+}
+
+// Write the partial aggregations (after a last sample) then close the files.
+func (h *histStore) stop(last bool) {
+	if last {
+		h.sample()
+	}
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	for l := 1; l < len(h.files); l++ {
+		h.flushLevel(l)
+	}
+	h.close()
+}
+
+func (h *histStore) close() {
+	for _, hf := range h.files {
+		hf.close()
+	}
+	h.files = nil
+}
+
+// Open, switch or close the history store (at startup and after a configuration reload).
+// Assumes the global maps are locked after a reload (hence no last sample of the previous store).
+func setHistory() error {
+	if history != nil && history.dir == historyDir {
+		sendLatest(historyc, historyStep)
+		return nil
+	}
+	if history != nil {
+		history.stop(false)
+		history = nil
+	}
+	if historyDir == "" {
+		sendLatest(historyc, 0)
+		return nil
+	}
+	if historyStep <= 0 {
+		return fmt.Errorf("Invalid history step %s.", historyStep)
+	}
+	h, err := openHistory(historyDir)
+	if err != nil {
+		return err
+	}
+	history = h
+	sendLatest(historyc, historyStep)
+	return nil
+}
+
+// Read the records of a history file, returns the size of its valid part.
+// The truncated end of a file (if we were killed while writing) is ignored.
+func readHistFile(fn string, rf func(*histRec), nf func(uint64, string)) (int64, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic := make([]byte, len(histMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil // Empty.
+		}
+		return 0, err
+	}
+	if string(magic) != histMagic {
+		return 0, fmt.Errorf("%s: not a trexec history file", fn)
+	}
+	off := int64(len(magic))
+	names := map[uint64]string{}
+	var lb [binary.MaxVarintLen64]byte
+	for {
+		t, err := br.ReadByte()
+		if err != nil {
+			return off, nil
+		}
+		l, err := binary.ReadUvarint(br)
+		if err != nil {
+			return off, nil
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return off, nil
+		}
+		switch t {
+		case 'n':
+			id, n := binary.Uvarint(b)
+			if n <= 0 {
+				return off, fmt.Errorf("%s: corrupted name", fn)
+			}
+			names[id] = string(b[n:])
+			if nf != nil {
+				nf(id, string(b[n:]))
+			}
+		case 'r':
+			r, err := decodeHistRec(b, names)
+			if err != nil {
+				return off, fmt.Errorf("%s: %s", fn, err)
+			}
+			rf(r)
+		}
+		off += 1 + int64(binary.PutUvarint(lb[:], l)) + int64(l)
+	}
+}
+
+// Decode the payload of a record.
+func decodeHistRec(b []byte, names map[uint64]string) (*histRec, error) {
+	var err error
+	uv := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			err = fmt.Errorf("corrupted record")
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	st, n := binary.Varint(b)
+	if n <= 0 {
+		return nil, fmt.Errorf("corrupted record")
+	}
+	b = b[n:]
+	r := &histRec{start: time.Unix(st, 0), cmds: map[string]*histCmd{}}
+	r.dur = time.Duration(uv()) * time.Millisecond
+	r.exec = uv()
+	nc := uv()
+	for i := uint64(0); i < nc && err == nil; i++ {
+		id := uv()
+		c := &histCmd{ec: uv(), et: uv() * 1000, subec: uv()}
+		r.cmds[names[id]] = c
+	}
+	return r, err
+}
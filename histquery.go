@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const sparkChars = " .:-=+*#%@" // ASCII sparkline levels (space is zero).
+
+// Parse a history time: a duration before now, a date or RFC3339.
+func parseHistTime(s string, now time.Time) (time.Time, error) {
+	if s == "" || s == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, l := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(l, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return now, fmt.Errorf("Invalid time '%s' (use a duration like 6h or a date like 2006-01-02 15:04).", s)
+}
+
+// Read the records of the history store between from and to.
+// The finest resolution available is used for every period.
+func readHistory(dir string, from, to time.Time) ([]*histRec, error) {
+	var recs []*histRec
+	cut := to.Add(time.Hour) // Start of the period already covered by a finer level.
+	found := false
+	for l := range histLevels {
+		var lrecs []*histRec
+		_, err := readHistFile(histFileName(dir, l), func(r *histRec) { lrecs = append(lrecs, r) }, nil)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		first := cut
+		for _, r := range lrecs {
+			if r.start.Before(first) {
+				first = r.start
+			}
+			if !r.start.Add(r.dur).After(cut) && r.start.Add(r.dur).After(from) && r.start.Before(to) {
+				recs = append(recs, r)
+			}
+		}
+		cut = first
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: no history store (see -H)", dir)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].start.Before(recs[j].start) })
+	return recs, nil
+}
+
+// Spread a value over the columns of a sparkline, in proportion of the time overlapped.
+func spread(cols []float64, from, to time.Time, r *histRec, v uint64) {
+	w := to.Sub(from) / time.Duration(len(cols))
+	if w <= 0 {
+		return
+	}
+	rs, re := r.start, r.start.Add(r.dur)
+	if r.dur <= 0 {
+		re = rs.Add(time.Millisecond)
+	}
+	for i := range cols {
+		cs := from.Add(w * time.Duration(i))
+		ce := cs.Add(w)
+		s, e := rs, re
+		if cs.After(s) {
+			s = cs
+		}
+		if ce.Before(e) {
+			e = ce
+		}
+		if e.After(s) {
+			cols[i] += float64(v) * float64(e.Sub(s)) / float64(re.Sub(rs))
+		}
+	}
+}
+
+// ASCII sparkline of some columns values.
+func sparkline(cols []float64) string {
+	var max float64
+	for _, v := range cols {
+		if v > max {
+			max = v
+		}
+	}
+	b := make([]byte, len(cols))
+	for i, v := range cols {
+		l := 0
+		if max > 0 && v > 0 {
+			l = 1 + int(v*float64(len(sparkChars)-2)/max+0.5)
+			if l >= len(sparkChars) {
+				l = len(sparkChars) - 1
+			}
+		}
+		b[i] = sparkChars[l]
+	}
+	return string(b)
+}
+
+// Display the top commands of a time range with their rate sparkline.
+func historyTop(recs []*histRec, from, to time.Time, width int) {
+	tot := &histRec{}
+	for _, r := range recs {
+		tot.add(r)
+	}
+	dts := to.Sub(from).Seconds()
+	cols := make([]float64, width)
+	for _, r := range recs {
+		spread(cols, from, to, r, r.exec)
+	}
+	printSep(out, " history from %s to %s (%d records) ", from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"), len(recs))
+	fmt.Fprintf(out, "total exec calls:   %d (%.2fe/s) |%s|\n", tot.exec, float64(tot.exec)/dts, sparkline(cols))
+	printSep(out, " top %d commands sorted by %s ", top, scStrings[sortCriteria])
+	var cmds []string
+	var set uint64
+	for c, h := range tot.cmds {
+		if h.ec != 0 || h.et != 0 {
+			cmds = append(cmds, c)
+		}
+		set += h.et
+	}
+	key := func(h *histCmd) uint64 {
+		if sortCriteria == scTime {
+			return h.et
+		}
+		return h.ec
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		a, b := tot.cmds[cmds[i]], tot.cmds[cmds[j]]
+		if key(a) != key(b) {
+			return key(a) > key(b)
+		}
+		return cmds[i] < cmds[j]
+	})
+	for i, c := range cmds {
+		if i >= top {
+			break
+		}
+		h := tot.cmds[c]
+		cols := make([]float64, width)
+		for _, r := range recs {
+			if rh, known := r.cmds[c]; known {
+				spread(cols, from, to, r, rh.ec)
+			}
+		}
+		ecpc := float32(h.ec*100) / float32(max64(int64(tot.exec), 1))
+		etpc := float32(h.et*100) / float32(max64(int64(set), 1))
+		fmt.Fprintf(out, "%s: %.2f%% (%d) %.2fe/s %s (%.2f%%) |%s|\n", c, ecpc, h.ec, float64(h.ec)/dts, time.Duration(h.et), etpc, sparkline(cols))
+	}
+	printSep(out, "")
+}
+
+// Display the rate timeline of a command.
+func historyCmd(recs []*histRec, from, to time.Time, width int, cmd string) {
+	var max float64
+	var ec, et uint64
+	var lines []*histRec
+	for _, r := range recs {
+		h, known := r.cmds[cmd]
+		if !known || r.dur <= 0 {
+			continue
+		}
+		if rate := float64(h.ec) / r.dur.Seconds(); rate > max {
+			max = rate
+		}
+		ec += h.ec
+		et += h.et
+		lines = append(lines, r)
+	}
+	cols := make([]float64, width)
+	for _, r := range lines {
+		spread(cols, from, to, r, r.cmds[cmd].ec)
+	}
+	printSep(out, " %s from %s to %s ", cmd, from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"))
+	fmt.Fprintf(out, "%s: %d exec (%.2fe/s) %s |%s|\n", cmd, ec, float64(ec)/to.Sub(from).Seconds(), time.Duration(et), sparkline(cols))
+	for _, r := range lines {
+		h := r.cmds[cmd]
+		rate := float64(h.ec) / r.dur.Seconds()
+		n := 0
+		if max > 0 {
+			n = int(rate*float64(width)/max + 0.5)
+		}
+		fmt.Fprintf(out, "%s %8s %8d %9.2fe/s %12s |%-*s|\n", r.start.Format("2006-01-02 15:04:05"), r.dur.Round(time.Second), h.ec, rate, time.Duration(h.et).Round(time.Microsecond), width, strings.Repeat("#", n))
+	}
+}
+
+// trexec history: query the history store.
+func historyMain(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s history [options]\n", path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nDisplay the per command counters recorded with -H: the top commands of a time range or the timeline of some commands (-cmd).\n")
+	}
+	dir := fs.String("H", "/var/lib/trexec", "directory of the history store.")
+	fromArg := fs.String("from", "24h", "start of the time range (a duration before now or a date).")
+	toArg := fs.String("to", "now", "end of the time range.")
+	var cmds stringList
+	fs.Var(&cmds, "cmd", "display the timeline of this command (comma separated, repeatable).")
+	sk := fs.String("s", "count", "sort criteria (count or time).")
+	fs.IntVar(&top, "t", 10, "number of lines in the top sections.")
+	width := fs.Int("w", 48, "width of the sparklines.")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *width <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *sk != "count" && *sk != "time" {
+		check(fmt.Errorf("Unknown sort criteria '%s'. Use -s 'count' or 'time'.", *sk))
+	}
+	check(setSortCriteria(*sk))
+	now := time.Now()
+	from, err := parseHistTime(*fromArg, now)
+	check(err)
+	to, err := parseHistTime(*toArg, now)
+	check(err)
+	if !to.After(from) {
+		check(fmt.Errorf("Empty time range (%s to %s).", from, to))
+	}
+	recs, err := readHistory(*dir, from, to)
+	check(err)
+	out = &outFile{f: os.Stdout}
+	getTermDimensions()
+	if len(cmds) == 0 {
+		historyTop(recs, from, to, *width)
+		return
+	}
+	for _, c := range cmds {
+		historyCmd(recs, from, to, *width, c)
+	}
+	printSep(out, "")
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+const htmlMaxNodes = 2000 // ancestry tree nodes in a report (the smallest branches are pruned).
+
+// Report view of a table row.
+type htmlRow struct {
+	Cmd   string
+	Exec  uint64
+	Pct   float64
+	Rate  float64
+	Time  uint64
+	TPct  float64
+	Mean  uint64 // mean execution time (ns).
+	Res   *resSnapshot
+	State string
+}
+
+// Report view of a histogram bucket.
+type htmlBar struct {
+	Label string
+	N     uint64
+	Pct   float64
+	X, H  int // svg coordinates.
+}
+
+// Report view of an ancestry tree node.
+type htmlNode struct {
+	treeSnapshot
+	Pct  float64 // share of the exec() of the subtree.
+	Open bool
+	Kids []*htmlNode
+}
+
+// Everything the report template needs.
+type htmlReport struct {
+	S        *snapshot
+	Title    string
+	Rate     float64
+	Dur      uint64
+	Bars     []htmlBar
+	HistW    int // histogram chart width.
+	Cmds     []htmlRow
+	Subs     []htmlRow
+	HasRes   bool
+	Tree     []*htmlNode
+	TreeMore bool // pruned branches.
+}
+
+func pct(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n*100) / float64(total)
+}
+
+// Build the report of a snapshot.
+func makeHTMLReport(s *snapshot) *htmlReport {
+	r := &htmlReport{S: s, Rate: s.rate(s.Exec), Dur: uint64(s.Duration), HistW: 20 + 64*len(s.Hist)}
+	r.Title = fmt.Sprintf("trexec report %s %s", s.Hostname, s.Date.Format("2006-01-02 15:04:05"))
+	var hs, hmax uint64
+	for _, n := range s.Hist {
+		hs += n
+		hmax = umax64(hmax, n)
+	}
+	p := 1
+	for l, n := range s.Hist {
+		p *= 10
+		b := htmlBar{Label: "<" + time.Duration(p).String(), N: n, Pct: pct(n, hs), X: 10 + l*64}
+		if hmax != 0 {
+			b.H = int(n * 160 / hmax)
+		}
+		r.Bars = append(r.Bars, b)
+	}
+	var set, sset uint64
+	for _, c := range s.Cmds {
+		set += c.Time
+		if !c.SubHide {
+			sset += c.SubTime
+		}
+	}
+	for _, c := range s.Cmds {
+		if c.Res != nil {
+			r.HasRes = true
+		}
+		if c.Exec != 0 || c.Time != 0 {
+			row := htmlRow{Cmd: c.Cmd, Exec: c.Exec, Pct: pct(c.Exec, s.Exec), Rate: s.rate(c.Exec), Time: c.Time, TPct: pct(c.Time, set), Res: c.Res}
+			if c.Exec != 0 {
+				row.Mean = c.Time / c.Exec
+			}
+			if c.Exec == 0 && c.Pre != 0 {
+				row.State = "pre-existing"
+			}
+			r.Cmds = append(r.Cmds, row)
+		}
+		if c.SubExec != 0 && !c.SubHide {
+			r.Subs = append(r.Subs, htmlRow{Cmd: c.Cmd, Exec: c.SubExec, Pct: pct(c.SubExec, s.Exec), Rate: s.rate(c.SubExec), Time: c.SubTime, TPct: pct(c.SubTime, sset), Mean: c.SubTime / c.SubExec, Res: c.SubRes})
+		}
+	}
+	if s.Tree != nil {
+		total := s.Tree.SubExec
+		// Keep the biggest branches: a node is kept if it has at least min exec() in its subtree.
+		var min uint64
+		for {
+			n := 0
+			var count func(t *treeSnapshot)
+			count = func(t *treeSnapshot) {
+				for i := range t.Kids {
+					if k := &t.Kids[i]; k.Exec+k.SubExec > min {
+						n++
+						count(k)
+					}
+				}
+			}
+			count(s.Tree)
+			if n <= htmlMaxNodes {
+				break
+			}
+			min = min*2 + 1
+			r.TreeMore = true
+		}
+		var conv func(t *treeSnapshot, depth int) []*htmlNode
+		conv = func(t *treeSnapshot, depth int) []*htmlNode {
+			var ns []*htmlNode
+			for i := range t.Kids {
+				k := &t.Kids[i]
+				if k.Exec+k.SubExec <= min {
+					continue
+				}
+				hn := &htmlNode{treeSnapshot: *k, Pct: pct(k.Exec+k.SubExec, total)}
+				hn.Open = depth < 2 || hn.Pct >= 20
+				hn.Kids = conv(k, depth+1)
+				ns = append(ns, hn)
+			}
+			return ns
+		}
+		r.Tree = conv(s.Tree, 0)
+	}
+	return r
+}
+
+var htmlFuncs = template.FuncMap{
+	"dur":   func(ns uint64) string { return time.Duration(ns).Round(time.Microsecond).String() },
+	"bytes": fmtBytes,
+	"kb":    func(n uint64) string { return fmtBytes(n * 1024) },
+	"sub":   func(a, b int) int { return a - b },
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(htmlFuncs).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>
+body{font-family:sans-serif;font-size:14px;margin:1em 2em;color:#222}
+h1{font-size:20px}h2{font-size:16px;margin-top:2em;border-bottom:1px solid #ccc}
+table{border-collapse:collapse}td,th{padding:2px 8px;text-align:right}td:first-child,th:first-child{text-align:left}
+th{background:#eee;cursor:pointer;user-select:none}th.asc:after{content:" \25B2"}th.desc:after{content:" \25BC"}
+tr:nth-child(even) td{background:#f7f7f7}table.meta td{text-align:left}
+.tree details,.tree .leaf{margin-left:1.2em}.tree summary,.tree .leaf{font-family:monospace;white-space:nowrap}
+.tree .n{color:#666}.bar{fill:#4a7ab5}svg text{font-size:11px;fill:#222}
+</style></head><body>
+<h1>{{.Title}}</h1>
+<table class="meta">
+<tr><td>hostname</td><td>{{.S.Hostname}}</td></tr>
+<tr><td>date</td><td>{{.S.Date.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><td>start</td><td>{{.S.Start.Format "2006-01-02 15:04:05 MST"}} ({{dur .Dur}})</td></tr>
+<tr><td>total exec calls</td><td>{{.S.Exec}} ({{printf "%.2f" .Rate}}e/s)</td></tr>
+<tr><td>forks w/o exec</td><td>{{.S.Forks}}</td></tr>
+<tr><td>exited processes</td><td>{{.S.Exit}}</td></tr>
+{{if .S.Dropped}}<tr><td>filtered out exec</td><td>{{.S.Dropped}}</td></tr>{{end}}
+<tr><td>pre-existing procs</td><td>{{.S.Pre}}</td></tr>
+<tr><td>number of commands</td><td>{{len .S.Cmds}}</td></tr>
+<tr><td>removed/vanished</td><td>{{.S.Removed}}/{{.S.Vanished}}</td></tr>
+</table>
+{{if .Bars}}<h2>Execution time histogram</h2>
+<svg width="{{.HistW}}" height="210">
+{{range .Bars}}<g><title>{{.N}} processes</title>
+<rect class="bar" x="{{.X}}" y="{{sub 180 .H}}" width="52" height="{{.H}}"/>
+<text x="{{.X}}" y="{{sub 174 .H}}">{{if .N}}{{printf "%.2f" .Pct}}%{{end}}</text>
+<text x="{{.X}}" y="198">{{.Label}}</text></g>
+{{end}}</svg>{{end}}
+<h2>Commands</h2>
+<table class="sortable"><thead><tr><th>command</th><th>exec</th><th>%</th><th>e/s</th><th>time</th><th>time %</th><th>mean time</th>{{if .HasRes}}<th>procs</th><th>max RSS</th><th>min flt</th><th>maj flt</th><th>read</th><th>write</th>{{end}}</tr></thead><tbody>
+{{range .Cmds}}<tr><td>{{.Cmd}}{{if .State}} [{{.State}}]{{end}}</td><td>{{.Exec}}</td><td>{{printf "%.2f" .Pct}}</td><td>{{printf "%.2f" .Rate}}</td><td data-v="{{.Time}}">{{dur .Time}}</td><td>{{printf "%.2f" .TPct}}</td><td data-v="{{.Mean}}">{{dur .Mean}}</td>{{if $.HasRes}}{{template "res" .Res}}{{end}}</tr>
+{{end}}</tbody></table>
+{{if .Subs}}<h2>Subtrees (sum of the sub processes)</h2>
+<table class="sortable"><thead><tr><th>command</th><th>sub exec</th><th>%</th><th>e/s</th><th>sub time</th><th>time %</th><th>mean time</th>{{if .HasRes}}<th>procs</th><th>max RSS</th><th>min flt</th><th>maj flt</th><th>read</th><th>write</th>{{end}}</tr></thead><tbody>
+{{range .Subs}}<tr><td>{{.Cmd}}</td><td>{{.Exec}}</td><td>{{printf "%.2f" .Pct}}</td><td>{{printf "%.2f" .Rate}}</td><td data-v="{{.Time}}">{{dur .Time}}</td><td>{{printf "%.2f" .TPct}}</td><td data-v="{{.Mean}}">{{dur .Mean}}</td>{{if $.HasRes}}{{template "res" .Res}}{{end}}</tr>
+{{end}}</tbody></table>{{end}}
+{{if .Tree}}<h2>Ancestry tree</h2>
+<p>exec() count of the command under this chain of ancestors, then the exec() count of its descendants and the share of the whole tree.{{if .TreeMore}} The smallest branches are not displayed.{{end}}</p>
+<div class="tree">{{range .Tree}}{{template "node" .}}{{end}}</div>{{end}}
+{{if .S.Sessions}}<h2>Sessions</h2>
+<table class="sortable"><thead><tr><th>session</th><th>tty</th><th>leader</th><th>user</th><th>exec</th><th>time</th></tr></thead><tbody>
+{{range .S.Sessions}}<tr><td>{{.Sid}}</td><td>{{.Tty}}</td><td>{{.Leader}}</td><td>{{.User}}</td><td>{{.Exec}}</td><td data-v="{{.Time}}">{{dur .Time}}</td></tr>
+{{end}}</tbody></table>{{end}}
+{{if .S.Ns}}<h2>Pid namespaces</h2>
+<table class="sortable"><thead><tr><th>namespace</th><th>init</th><th>exec</th><th>time</th></tr></thead><tbody>
+{{range .S.Ns}}<tr><td>{{if .Host}}host{{else}}{{.Ino}}{{end}}</td><td>{{.Init}}{{if .InitPid}} (host pid {{.InitPid}}){{end}}</td><td>{{.Exec}}</td><td data-v="{{.Time}}">{{dur .Time}}</td></tr>
+{{end}}</tbody></table>{{end}}
+<script>
+document.querySelectorAll("table.sortable th").forEach(function(th) {
+	th.addEventListener("click", function() {
+		var table = th.closest("table"), col = Array.prototype.indexOf.call(th.parentNode.children, th);
+		var desc = !th.classList.contains("desc");
+		th.parentNode.querySelectorAll("th").forEach(function(h) { h.classList.remove("asc", "desc"); });
+		th.classList.add(desc ? "desc" : "asc");
+		var val = function(tr) {
+			var td = tr.children[col], v = td.getAttribute("data-v");
+			if (v === null) v = td.textContent;
+			var n = parseFloat(v);
+			return isNaN(n) ? v.toLowerCase() : n;
+		};
+		var tbody = table.tBodies[0], rows = Array.prototype.slice.call(tbody.rows);
+		rows.sort(function(a, b) {
+			var x = val(a), y = val(b);
+			var c = x < y ? -1 : x > y ? 1 : 0;
+			return desc ? -c : c;
+		});
+		rows.forEach(function(r) { tbody.appendChild(r); });
+	});
+});
+</script>
+</body></html>
+{{define "res"}}{{if .}}<td>{{.Procs}}</td><td data-v="{{.MaxRSS}}">{{kb .MaxRSS}}</td><td>{{.MinFlt}}</td><td>{{.MajFlt}}</td><td data-v="{{.Read}}">{{bytes .Read}}</td><td data-v="{{.Write}}">{{bytes .Write}}</td>{{else}}<td></td><td></td><td></td><td></td><td></td><td></td>{{end}}{{end}}
+{{define "node"}}{{if .Kids}}<details{{if .Open}} open{{end}}><summary>{{.Cmd}} <span class="n">{{.Exec}} +{{.SubExec}} ({{printf "%.2f" .Pct}}%) {{dur .Time}}</span></summary>{{range .Kids}}{{template "node" .}}{{end}}</details>{{else}}<div class="leaf">{{.Cmd}} <span class="n">{{.Exec}} ({{printf "%.2f" .Pct}}%) {{dur .Time}}</span></div>{{end}}{{end}}
+`))
+
+// Write the HTML report of a snapshot.
+func writeHTMLReport(w io.Writer, s *snapshot) error {
+	return htmlTemplate.Execute(w, makeHTMLReport(s))
+}
+
+// Output the stats as an HTML report.
+func statsHTML() {
+	if err := writeHTMLReport(out, takeSnapshot()); err != nil {
+		logf(prioErr, "html: %s", err)
+	}
+}
+
+func htmlMain(args []string) {
+	fs := flag.NewFlagSet("html", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s html [-o report.html] snapshot.json\n", path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nGenerate a self-contained HTML report from a snapshot saved with -f json (the last snapshot of the file is used).\n")
+	}
+	ofn := fs.String("o", "", "report file (default is stdout).")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	s, err := readSnapshot(fs.Arg(0))
+	check(err)
+	w := os.Stdout
+	if *ofn != "" {
+		w, err = os.Create(*ofn)
+		check(err)
+	}
+	check(writeHTMLReport(w, s))
+	check(w.Close())
+}
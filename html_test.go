@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMakeHTMLReport(t *testing.T) {
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	res := &resSnapshot{Procs: 2, MaxRSS: 100}
+	s := &snapshot{
+		Hostname: "h",
+		Date:     date,
+		Start:    date.Add(-2 * time.Second),
+		Duration: int64(2 * time.Second),
+		Exec:     4,
+		Hist:     []uint64{0, 1, 3},
+		Cmds: []cmdSnapshot{
+			{Cmd: "sh", Exec: 3, Time: 3000, SubExec: 1, SubTime: 1000, Res: res},
+			{Cmd: "ls", Exec: 1, Time: 1000},
+			{Cmd: "cron", Time: 4000, Pre: 1},
+			{Cmd: "systemd", SubExec: 4, SubTime: 5000, SubHide: true},
+		},
+		Tree: &treeSnapshot{SubExec: 10, Kids: []treeSnapshot{
+			{Cmd: "cron", SubExec: 4, Kids: []treeSnapshot{
+				{Cmd: "sh", Exec: 3, SubExec: 1, Kids: []treeSnapshot{{Cmd: "ls", Exec: 1}}},
+			}},
+		}},
+	}
+	r := makeHTMLReport(s)
+	if want := "trexec report h 2024-01-02 03:04:05"; r.Title != want {
+		t.Errorf("title: got %q, want %q", r.Title, want)
+	}
+	if r.Rate != 2 || r.Dur != uint64(2*time.Second) || !r.HasRes || r.TreeMore {
+		t.Errorf("got rate %v dur %d res %v more %v", r.Rate, r.Dur, r.HasRes, r.TreeMore)
+	}
+	wantBars := []htmlBar{
+		{Label: "<10ns", X: 10},
+		{Label: "<100ns", N: 1, Pct: 25, X: 74, H: 53},
+		{Label: "<1µs", N: 3, Pct: 75, X: 138, H: 160},
+	}
+	if !reflect.DeepEqual(r.Bars, wantBars) || r.HistW != 20+64*3 {
+		t.Errorf("bars: got %+v width %d, want %+v width %d", r.Bars, r.HistW, wantBars, 20+64*3)
+	}
+	wantCmds := []htmlRow{
+		{Cmd: "sh", Exec: 3, Pct: 75, Rate: 1.5, Time: 3000, TPct: 37.5, Mean: 1000, Res: res},
+		{Cmd: "ls", Exec: 1, Pct: 25, Rate: 0.5, Time: 1000, TPct: 12.5, Mean: 1000},
+		{Cmd: "cron", Time: 4000, TPct: 50, State: "pre-existing"},
+	}
+	if !reflect.DeepEqual(r.Cmds, wantCmds) {
+		t.Errorf("commands: got %+v, want %+v", r.Cmds, wantCmds)
+	}
+	// The -hide-sub commands are not in the subtrees list nor in its total time.
+	wantSubs := []htmlRow{{Cmd: "sh", Exec: 1, Pct: 25, Rate: 0.5, Time: 1000, TPct: 100, Mean: 1000}}
+	if !reflect.DeepEqual(r.Subs, wantSubs) {
+		t.Errorf("subtrees: got %+v, want %+v", r.Subs, wantSubs)
+	}
+	if len(r.Tree) != 1 || r.Tree[0].Cmd != "cron" || r.Tree[0].Pct != 40 || !r.Tree[0].Open {
+		t.Fatalf("tree: got %+v", r.Tree)
+	}
+	sh := r.Tree[0].Kids[0]
+	if sh.Cmd != "sh" || sh.Pct != 40 || !sh.Open || len(sh.Kids) != 1 {
+		t.Fatalf("tree: got %+v", sh)
+	}
+	if ls := sh.Kids[0]; ls.Cmd != "ls" || ls.Pct != 10 || ls.Open || ls.Kids != nil {
+		t.Errorf("tree: got %+v", ls)
+	}
+}
+
+func TestMakeHTMLReportPrune(t *testing.T) {
+	// More nodes than htmlMaxNodes: the branches with a single exec() are pruned.
+	root := &treeSnapshot{}
+	for i := 0; i < htmlMaxNodes; i++ {
+		root.Kids = append(root.Kids, treeSnapshot{Cmd: "a", Exec: 1})
+	}
+	root.Kids = append(root.Kids, treeSnapshot{Cmd: "b", Exec: 2})
+	r := makeHTMLReport(&snapshot{Tree: root})
+	if !r.TreeMore || len(r.Tree) != 1 || r.Tree[0].Cmd != "b" {
+		t.Errorf("got more %v and %d nodes", r.TreeMore, len(r.Tree))
+	}
+}
+
+func TestWriteHTMLReport(t *testing.T) {
+	s := &snapshot{Hostname: "h", Exec: 1, Cmds: []cmdSnapshot{{Cmd: "<script>", Exec: 1}}}
+	var b bytes.Buffer
+	if err := writeHTMLReport(&b, s); err != nil {
+		t.Fatal(err)
+	}
+	if h := b.String(); strings.Contains(h, "<td><script>") || !strings.Contains(h, "<td>&lt;script&gt;</td>") {
+		t.Errorf("the command name is not escaped")
+	}
+}
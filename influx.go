@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var influxURL string   // -influx-url: InfluxDB (or compatible) write endpoint.
+var influxToken string // -influx-token: InfluxDB 2 API token.
+
+var influxClient = &http.Client{Timeout: 10 * time.Second}
+var influxMut sync.Mutex // held during a push.
+
+func init() {
+	atExit(func() {
+		if influxURL != "" {
+			influxMut.Lock()
+			postInflux(influxLines(takeSnapshot()))
+		}
+	})
+}
+
+// The line protocol has no newline in the names and tags: written as \n (the backslashes doubled).
+var influxKeyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, `\`, `\\`, "\n", `\n`)
+var influxMeasEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, `\`, `\\`, "\n", `\n`)
+
+// A line protocol point.
+type influxPoint struct {
+	b *bytes.Buffer
+	n int // number of fields.
+}
+
+// Start a point: measurement and tags (key, value pairs, the empty values are skipped).
+func influxLine(b *bytes.Buffer, m string, tags ...string) *influxPoint {
+	b.WriteString(influxMeasEscaper.Replace(m))
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] == "" {
+			continue
+		}
+		fmt.Fprintf(b, ",%s=%s", influxKeyEscaper.Replace(tags[i]), influxKeyEscaper.Replace(tags[i+1]))
+	}
+	return &influxPoint{b: b}
+}
+
+func (p *influxPoint) sep() {
+	if p.n == 0 {
+		p.b.WriteByte(' ')
+	} else {
+		p.b.WriteByte(',')
+	}
+	p.n++
+}
+
+// Integer field.
+func (p *influxPoint) i(k string, v uint64) *influxPoint {
+	p.sep()
+	fmt.Fprintf(p.b, "%s=%di", influxKeyEscaper.Replace(k), v)
+	return p
+}
+
+// Float field.
+func (p *influxPoint) f(k string, v float64) *influxPoint {
+	p.sep()
+	fmt.Fprintf(p.b, "%s=%s", influxKeyEscaper.Replace(k), strconv.FormatFloat(v, 'f', -1, 64))
+	return p
+}
+
+// End the point with its time stamp.
+func (p *influxPoint) end(t time.Time) {
+	fmt.Fprintf(p.b, " %d\n", t.UnixNano())
+}
+
+// Line protocol points of a snapshot: one measurement per stats section, the command (session, namespace...) as a tag.
+func influxLines(s *snapshot) []byte {
+	b := &bytes.Buffer{}
+	t := s.Date
+	h := s.Hostname
+	influxLine(b, "trexec", "host", h).
+		i("exec", s.Exec).f("exec_rate", s.rate(s.Exec)).
+		i("forks_without_exec", s.Forks).i("exit", s.Exit).i("filtered_out", s.Dropped).
+		i("pre_existing", s.Pre).i("commands", uint64(len(s.Cmds))).
+		i("removed", s.Removed).i("vanished", s.Vanished).i("duration_ns", uint64(s.Duration)).end(t)
+	p := 1
+	for _, n := range s.Hist {
+		p *= 10
+		if n != 0 {
+			influxLine(b, "trexec_hist", "host", h, "lt", time.Duration(p).String()).i("count", n).end(t)
+		}
+	}
+	for _, c := range s.Cmds {
+		pt := influxLine(b, "trexec_cmd", "host", h, "cmd", c.Cmd).
+			i("exec", c.Exec).f("exec_rate", s.rate(c.Exec)).i("time_ns", c.Time).
+			i("sub_exec", c.SubExec).f("sub_exec_rate", s.rate(c.SubExec)).i("sub_time_ns", c.SubTime)
+		if c.Pre != 0 {
+			pt.i("pre_existing", c.Pre)
+		}
+		if r := c.Res; r != nil {
+			pt.i("procs", r.Procs).i("max_rss_kb", r.MaxRSS).i("sum_rss_kb", r.RSS).
+				i("minflt", r.MinFlt).i("majflt", r.MajFlt).i("read_bytes", r.Read).i("write_bytes", r.Write).i("cpu_ns", r.CPU)
+		}
+		pt.end(t)
+	}
+	for _, ss := range s.Sessions {
+		influxLine(b, "trexec_session", "host", h, "sid", strconv.Itoa(ss.Sid), "tty", ss.Tty, "leader", ss.Leader, "user", ss.User).
+			i("exec", ss.Exec).f("exec_rate", s.rate(ss.Exec)).i("time_ns", ss.Time).end(t)
+	}
+	for _, ns := range s.Ns {
+		name := strconv.FormatUint(ns.Ino, 10)
+		if ns.Host {
+			name = "host"
+		}
+		influxLine(b, "trexec_pidns", "host", h, "ns", name, "init", ns.Init).
+			i("exec", ns.Exec).f("exec_rate", s.rate(ns.Exec)).i("time_ns", ns.Time).end(t)
+	}
+	return b.Bytes()
+}
+
+// Output the stats as line protocol points.
+func statsInflux() {
+	out.Write(influxLines(takeSnapshot()))
+}
+
+// Send the current stats to the InfluxDB write endpoint in the background.
+// The points are taken now (before a clear of the counters), a push is skipped while the previous one is still running.
+func pushInflux() {
+	if influxURL == "" {
+		return
+	}
+	b := influxLines(takeSnapshot())
+	go func() {
+		if !influxMut.TryLock() {
+			logf(prioWarning, "influx: previous push still running, skipping this one")
+			return
+		}
+		defer influxMut.Unlock()
+		postInflux(b)
+	}()
+}
+
+// Send points to the InfluxDB write endpoint.
+func postInflux(b []byte) {
+	req, err := http.NewRequest("POST", influxURL, bytes.NewReader(b))
+	if err != nil {
+		logf(prioErr, "influx: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if influxToken != "" {
+		req.Header.Set("Authorization", "Token "+influxToken)
+	}
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		logf(prioErr, "influx: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		logf(prioErr, "influx: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	tests := []struct {
+		name string
+		m    string
+		tags []string
+		want string
+	}{
+		{"plain", "trexec_cmd", []string{"host", "h", "cmd", "awk"}, `trexec_cmd,host=h,cmd=awk exec=1i 42`},
+		{"empty tag", "trexec_cmd", []string{"host", "h", "cmd", ""}, `trexec_cmd,host=h exec=1i 42`},
+		{"comma space equal", "trexec_cmd", []string{"cmd", "a b,c=d"}, `trexec_cmd,cmd=a\ b\,c\=d exec=1i 42`},
+		{"backslash", "trexec_cmd", []string{"cmd", `a\b`}, `trexec_cmd,cmd=a\\b exec=1i 42`},
+		{"newline", "trexec_cmd", []string{"cmd", "a\nb"}, `trexec_cmd,cmd=a\nb exec=1i 42`},
+		{"tag key", "trexec_cmd", []string{"a b=c", "v"}, `trexec_cmd,a\ b\=c=v exec=1i 42`},
+		{"measurement", "m e,a=s\n", nil, `m\ e\,a=s\n exec=1i 42`},
+	}
+	for _, tt := range tests {
+		b := &bytes.Buffer{}
+		influxLine(b, tt.m, tt.tags...).i("exec", 1).end(time.Unix(0, 42))
+		if got := b.String(); got != tt.want+"\n" {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want+"\n")
+		}
+	}
+}
+
+func TestInfluxFields(t *testing.T) {
+	b := &bytes.Buffer{}
+	influxLine(b, "trexec").i("exec", 3).f("exec_rate", 1.5).i("a b", 0).end(time.Unix(1, 0))
+	want := "trexec exec=3i,exec_rate=1.5,a\\ b=0i 1000000000\n"
+	if got := b.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
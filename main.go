@@ -16,7 +16,7 @@ var myUsage = func() {
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, `
 Display statistics about exec() system calls.
-Note that you need to have root privileges.
+Note that you need to have root privileges (or at least the CAP_NET_ADMIN capability, CAP_SYS_PTRACE is needed to read some /proc/[pid] files of other users).
 You can ask for an updated summary by sending SIGUSR1 to the process or let it do a periodic output with the -i flag.
 
 eg: %s -i 30s -o /tmp/%s.out
@@ -24,31 +24,167 @@ eg: %s -i 30s -o /tmp/%s.out
   Every time you send a SIGUSR1 to the process (eg: pkill -10 %s), you will also get a fresh summary.
   If you want a reset of the counters (like -c) you can use SIGUSR2.
 
+Configuration file:
+The options can also be set in a file given with -C (a subset of TOML). Flags given on the command line override the file values.
+Keys are the flag names (or output, interval, sort, top, clear, raw and format for the one letter flags). Repeatable flags take an array.
+eg:
+  output = "/var/log/%s.out"
+  interval = "1m"
+  exclude = ["anc=zabbix_agentd", "uid=nagios"]
+Send a SIGHUP to reload the file, the counters are kept.
+
+Run mode:
+  %s [options] -- command [args]
+Runs the command and only accounts the exec() of its descendants (using the processes ancestry). The stats are displayed when the command exits and %s exits with the command status (like time but for process spawning).
+eg: %s -- make -j8
+Note that the daemonized processes (reparented to init) are not accounted.
+
+Attach mode:
+With -p pid (repeatable) only the processes whose ancestry reaches one of the given pids are accounted. The percentages are then relative to these subtrees.
+eg: %s -p $(pgrep -o crond) -i 10m
+  This displays the activity of the cron jobs every 10 minutes.
+
+Snapshots:
+With -f json every stats display is a single line json document with the counters of all the commands. Two of these snapshots can be compared with:
+  %s diff [-json] [-s count|time] [-t top] before.json after.json
+It reports the exec counts, rates and execution time changes per command and per subtree, the new and disappeared commands and the histogram shifts.
+A snapshot can also be turned into a self-contained HTML report (sortable tables, histogram chart, collapsible ancestry tree with -A):
+  %s html [-o report.html] snap.json
+With -f html every stats display is directly such a report (use it with -snapshots).
+With -f csv every stats display is a set of csv rows, one per command (section cmd) and per subtree (section sub), in raw units (counts, nanoseconds, exec per second). The header row is written at the beginning of every output file:
+  date,section,cmd,exec,exec_pct,exec_rate,time_ns,time_pct,mean_time_ns,pre_existing,procs,rss_procs,max_rss_kb,sum_rss_kb,minflt,majflt,read_bytes,write_bytes,cpu_ns
+The usage columns are only filled with -m.
+The ancestry tree (-A) can be explored with go tool pprof (top, tree, web, diff...): every command is a "function" and its ancestry the "stack", the sample values are the exec count, the wall clock execution time and the CPU time (with -m).
+  %s pprof [-o spawn.pb.gz] snap.json
+With -f pprof every stats display is directly such a profile, it needs -snapshots (a file per display) or the run mode without -i.
+eg: %s -A -m -f pprof -o /tmp/make.pb.gz -- make -j8 && go tool pprof -top -sample_index=cpu /tmp/make.pb.gz
+
+Output files:
+The output file is never truncated, new stats are appended. It can be rotated by size (-rotate-size) or age (-rotate-time): it is then renamed with a time stamp suffix (and compressed with -rotate-gzip).
+With -snapshots every stats display is written in its own file named after the output file followed by a time stamp.
+The rotated and snapshot files older than -rotate-keep are removed.
+eg: %s -i 1m -o /var/log/%s/snap -snapshots -rotate-gzip -rotate-keep 168h
+  This keeps a week of 1 minute snapshots.
+A SIGHUP reopens the output file (eg: after logrotate moved it).
+
+History:
+With -H dir the per command counters are recorded every -history-step (1m) in an append-only store. Older records are downsampled: 1m records are kept for a day, 10m records for a week and 1h records for 3 months.
+  %s history [-H dir] [-from 24h] [-to time] [-cmd name] [-t top] [-s count|time] [-w width]
+It prints the top commands of a past time range with a sparkline of their exec rate, or the rate timeline of the given commands (-cmd).
+eg: %s history -from 6h -cmd awk
+Times are durations before now (eg: 6h) or dates (eg: 2006-01-02 15:04 or RFC3339).
+
+InfluxDB:
+With -f influx every stats output is a set of InfluxDB line protocol points (nanosecond time stamps, host tag): trexec (the header counters), trexec_hist (lt tag), trexec_cmd (cmd tag), trexec_session (-S) and trexec_pidns (-ns). The output files can be archived or loaded later.
+With -influx-url the points are also sent to an InfluxDB (or VictoriaMetrics) write endpoint at every stats output.
+eg: %s -i 1m -o /dev/null -influx-url 'http://localhost:8086/api/v2/write?org=ops&bucket=trexec' -influx-token $TOKEN
+eg: trexec_cmd,host=web1,cmd=awk exec=60641i,exec_rate=298.16,time_ns=6653131070i,sub_exec=0i,sub_exec_rate=0,sub_time_ns=0i 1700000000000000000
+
+StatsD:
+With -statsd host:port the counters changes are pushed at every interval (-i) to a StatsD or DogStatsD (-statsd-format dogstatsd) server over UDP:
+  exec, forks_without_exec, exit, filtered_out (counters), commands and processes (gauges),
+  exec_time.lt_10ms... (exec_time.bucket tagged lt:10ms with dogstatsd) the number of exited processes per histogram bucket,
+  cmd.<cmd>.exec, cmd.<cmd>.time_ms and cmd.<cmd>.sub_exec (tagged cmd:<cmd> with dogstatsd) for the top commands (-t) of the interval.
+eg: %s -i 10s -statsd 127.0.0.1:8125 -statsd-format dogstatsd -statsd-tags hostname,cgroup,env:prod
+The last changes are pushed when %s exits.
+
+OpenTelemetry:
+With -otlp url the metrics are pushed at every interval (-i) to an OpenTelemetry collector with OTLP (http/protobuf or grpc). They are cumulative since the start (or the last clear of the counters):
+  trexec.exec, trexec.forks_without_exec, trexec.exit, trexec.filtered_out (counters),
+  trexec.command.exec, trexec.command.duration (s) and trexec.command.sub_exec with a command.name attribute,
+  trexec.process.duration: the execution time distribution as exponential histograms, for all the processes and per command.
+The resource attributes are service.name, host.name and the -otlp-attrs ones. The number of command.name values is capped by -otlp-max-cmds: the first most exec()ed commands keep their series, the others are accounted as _other.
+eg: %s -i 30s -otlp http://otel-collector:4317 -otlp-protocol grpc -otlp-attrs deployment.environment=prod
+
+Event stream:
+With -events file every exec and exit event is also written as a structured record (JSON lines or logfmt with -events-format logfmt), like execsnoop but with the ancestry of the processes:
+  {"time":"2026-01-02T15:04:05.123456789Z","event":"exec","pid":4242,"ppid":4240,"cmd":"awk","uid":0,"ancestry":["sh","hellscript.sh","crond","systemd"]}
+  {"time":"2026-01-02T15:04:05.125456789Z","event":"exit","pid":4242,"ppid":4240,"cmd":"awk","uid":0,"ancestry":["sh","hellscript.sh","crond","systemd"],"duration_ns":2000000,"exit_status":0}
+The exit events have the execution time and the exit status (or the signal that killed the process). Only the events that pass the collection filters are written; -events-filter restricts them further and -events-sample N only keeps 1 process out of N. With -ns the records also have the pid namespace (pidns) and the pid of the process in it (nspid).
+eg: %s -events - -events-filter anc=crond -events-format logfmt
+
+Syslog:
+With -syslog a summary of the interval (-i) is sent to syslog (RFC 5424 with structured data, facility daemon) or to the systemd journal (TREXEC_* fields):
+  -syslog journal, -syslog unix (/dev/log), -syslog unix:/path/to/socket or -syslog udp:host:port.
+The summary has the exec, forks without exec, exit and filtered out counts, the exec rate and the top commands (cmd:exec:time).
+With -syslog-storm rate a warning (msgid/TREXEC_EVENT storm) is sent when the exec rate of an interval reaches this rate, and a notice (storm_end) when it is back below.
+eg: %s -d -i 1m -o /dev/null -syslog udp:loghost:514 -syslog-storm 500
+
+Web dashboard:
+With -http addr a small web UI is served (embedded, no external assets): live exec rate, top commands, subtrees and the execution time histogram, with controls to change the sort criteria and to clear the counters. It is updated every 2s with server-sent events (or polling).
+  GET /api/dashboard?top=n&sort=count|time|rss|faults|io (the dashboard data), GET /api/stream?top=n&sort=... (the same as server-sent events), POST /api/reset (with Content-Type: application/json).
+The same server has a JSON query API. The sort (count, time, rss, faults or io), top (0 for all) and window (eg: 5m) parameters default to -s, -t and the counters since the start (or the last clear):
+  GET /api/snapshot?sort&top&window (the -f json snapshot, all the commands unless top is given), GET /api/commands?sort&top&window&sub=1 (the commands or, with sub=1, the subtrees),
+  GET /api/commands/{name}?window, GET /api/commands/{name}/children?sort&top (the commands exec()ed by its children, needs -A),
+  GET /api/tree?top&depth (the ancestry tree, needs -A), GET /api/histogram?window&cmd, POST /api/reset.
+The counters are sampled every 15s for the time windows (up to 6h): a window covers the changes since the last sample at least that old, with the exec count, execution time and sub exec count of the commands.
+There is no authentication: listen on localhost (or behind an authenticating proxy) on shared hosts.
+eg: curl -s 'localhost:8080/api/commands?window=5m&top=5&sort=time'
+eg: %s -d -http localhost:8080
+
+Daemon mode:
+With -d, %s is meant to run as a systemd service (see the trexec.service unit file template): it notifies systemd when it is ready, handles the watchdog and logs to the journal.
+On SIGTERM the stats are displayed and all the outputs are flushed before exiting.
+
 Notes about the displayed informations:
 
 The header should be self explanatory.
+At startup the already running processes are read from /proc so that their descendants are attributed to them from the first event. They are counted as pre-existing processes and not as exec() calls, only their execution time since the start (or the last clear) is accounted.
 
 The histogramm helps understand the processes execution time distribution. Every time a process dies its (wall clock) execution time is accounted in a power of 10 ns scale.
+Under the histogram, the 3 commands that dominate every bucket are listed (who are the sub-millisecond processes?).
+eg: <10ms   grep 61.20%% (4210) awk 20.03%% (1378) sed 9.45%% (650)
 
 The first list displays statistics on a per command basis. The most frequently exec()ed commands or the longest (wall clock) commands.
-eg: awk: 53.15%% (60641) 298.16e/s 6.65313107s (15.01%)
+eg: awk: 53.15%% (60641) 298.16e/s 6.65313107s (15.01%%)
   Meaning that awk is the most often exec()ed command (53%%) on the server.
   It has been started 60641 times during this %s session.
   It is (on average) exec()ed 298 times per second.
-  It's total wall clock execution time is 6.6s for 15% of the execution time of all processes that were execed/exited during this session.
+  It's total wall clock execution time is 6.6s for 15%% of the execution time of all processes that were execed/exited during this session.
   Note that the times used are exit-exec timesand thus are not always relevant to the real CPU load of a process. (eg: a sleep command would account for a big chunck of execution time without using CPU time.)
 
 
 The second list displays statistics for a command and all its subprocesses. Eg: the commands that are the source of the biggest number of exec() syscalls. (ie: them and all their descendants.)
 This should help to find the script of hell that is forking 300 awk per second.
-eg: hellscript.sh: 68.29%% (259650) 395.42e/s 6.86371307s (15.23%)
+eg: hellscript.sh: 68.29%% (259650) 395.42e/s 6.86371307s (15.23%%)
   This line means that hellscript commands (and all descendants) are exec()ing 68%% of all the processes on the server (259650 in this %s session).
   The process tree rooted at hellscript (note that there may be more than one hellscript) is calling exec() at an average rate of 395/s.
   The sum of all percentages will not be 100%% because we count every exec() event once per parent of the process (all its ancestors).
-  The execution time can also indicate source of CPU load, 15% of the wall clock time is attributable to hellscript and its descendants. Note that this is not real CPU execution time but wall clock time (eg: a sleep 10s will add 10s to this metric)
-Note that to clarify this list we ignode some obvious processes statistics (init, systemd, ...)
+  The execution time can also indicate source of CPU load, 15%% of the wall clock time is attributable to hellscript and its descendants. Note that this is not real CPU execution time but wall clock time (eg: a sleep 10s will add 10s to this metric)
+Note that to clarify this list we ignode some obvious processes statistics (init, systemd, ...), see the -hide-sub option.
+
+Filters:
+A filter is key=value (exact match) or key~regexp. Several filters can be given with a comma separated list or by repeating the option.
+  cmd     the command name (as in /proc/[pid]/stat).
+  exe     the executable path (/proc/[pid]/exe).
+  uid     the owner uid (a user name is also accepted with =).
+  cgroup  the cgroup path (any hierarchy).
+  anc     the command name of any ancestor.
+  pidns   the pid namespace inode number (or host for our own namespace).
+  mntns   the mount namespace inode number (or host).
+-exclude and -include are applied when the exec() event is received. Dropped events cost almost no CPU and are not accounted at all.
+-hide and -show are applied when the stats are displayed. They match the attributes of the last accounted instance of a command. -hide-sub only removes commands from the subtrees lists (by default init and systemd, every process is in their subtree).
+eg: %s -exclude anc=zabbix_agentd -exclude uid=nagios -hide cmd~'^(init|systemd|bash)$'
  
-You can sort commands by number of exec() calls or wall clock execution time (using the -s option).
+With -a an extra list displays, for the most exec()ed commands, their most frequent argument patterns. The numbers, paths and quoted strings of the command lines are replaced by <n>, <path> and <str> placeholders and a few full command lines are given as examples.
+eg: grep: 6870
+      90.00%% (6183) grep -c ESTABLISHED
+          eg: grep -c ESTABLISHED
+      9.00%% (618) grep -q <str> <path>
+          eg: grep -q "model name" /proc/cpuinfo
+
+With -cwd and -env the working directory and some environment variables are read when a command is exec()ed. A few distinct examples are kept per command and displayed for the most exec()ed commands. They help finding the owner of a command (eg: -env SUDO_USER,CRON_JOB).
+
+With -S the exec() events are also grouped by session (session id, terminal, session leader command and owner). On a bastion host it shows which user's shell loop is hammering the box. The interactive (processes with a controlling terminal) versus non-interactive activity is also displayed.
+
+With -A the exec() events are also aggregated by ancestry chain (eg: systemd/crond/sh/hellscript.sh/awk) and the tree branches with more than 1%% of the exec are displayed.
+With -ns the pid and mount namespaces of the processes are recorded and the exec() events are also grouped by pid namespace. Every namespace is named after its init process (pid 1 in the namespace) with its host pid so that the stats can be given to the container owners in their terms. Use the pidns and mntns filters to focus on a container (eg: -include pidns=4026532198) or to ignore the host (-exclude pidns=host).
+
+With -m the memory and I/O usage of every exiting process is sampled: peak RSS, minor/major page faults, storage read/write bytes and CPU time. They come from the kernel taskstats (sent just before the exit event, it needs CAP_NET_ADMIN). Without taskstats they are read from /proc/[pid]/stat and io at exit: the peak RSS is then not available and the I/O of the reaped children is subtracted from their parent. The usage is displayed under every command line, per command and per subtree.
+eg: make: 0.65%% (2) 0.10e/s 12.3s (30.1%%)
+      rss max 2.1MiB avg 1.9MiB, faults 1840/0, io r 0B w 12.0KiB
+
+You can sort commands by number of exec() calls or wall clock execution time (using the -s option). With -m they can also be sorted by peak RSS (the sum of the peaks of all the instances), page faults or I/O bytes.
 
 This script is optimized to track all the exec()/exit() system calls on the server (using a Netlink socket from the kernel). But if the server is heavily loaded or if some proceesses are very short lived, then we may be too late to get the data from /proc/[pid]/. In this case the command is reported as (vanished).
 Note that the CPU load is not proportional to the number of forked processes. But if a script is forking a lot of commands it may create a significant system load that is quite hard to track (sampling tools like top are not helping).
@@ -56,12 +192,11 @@ Only exec() events are handled, so some pathological load profiles with a lot of
 This (go) code should be very light (typical: <1%% CPU and <10M RSS), you can use it in production environments with no noticeable impact on performances.
 
 If you need more help feel free to contact Olivier Arsac trexec@arsac.org.
-`, c, c, c, c, c, c)
+`, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c, c)
 }
 
 var sortKey string
 var outfn string
-var out *os.File
 var interval time.Duration
 var top int
 var raw, clear bool
@@ -69,62 +204,258 @@ var raw, clear bool
 // Ccheck e, if not nil print to stderr and exit.
 func check(e error) {
 	if e != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
-		os.Exit(1)
+		logf(prioErr, "%s", e)
+		shutdown(1)
 	}
 }
 
 func parseOpts() {
 	flag.Usage = myUsage
 	flag.StringVar(&outfn, "o", "", "output file (default is stdout).")
-	flag.StringVar(&sortKey, "s", "count", "sort criteria (count or time, default is count).")
+	flag.StringVar(&sortKey, "s", "count", "sort criteria (count or time, with -m also rss, faults or io, default is count).")
 	flag.DurationVar(&interval, "i", 0, "interval between automatic stats output (eg: 30s, 10m, 2h).")
+	flag.StringVar(&outFormat, "f", "text", "output format (text, json, influx line protocol, html, csv or pprof).")
 	flag.BoolVar(&raw, "r", false, "output stats in a raw format easier to parse unsing scripts).")
 	flag.BoolVar(&clear, "c", false, "clear counters every time we display stats.")
 	flag.IntVar(&top, "t", 10, "number of lines in the top sections.")
+	flag.BoolVar(&argsOn, "a", false, "group the commands by argument pattern (reads /proc/[pid]/cmdline).")
+	flag.BoolVar(&cwdOn, "cwd", false, "keep examples of the working directory of the commands.")
+	flag.Var(&envKeys, "env", "keep examples of these environment variables of the commands (comma separated, repeatable. eg: SUDO_USER,HOSTNAME).")
+	flag.BoolVar(&sessionsOn, "S", false, "display the stats per login session and interactive (with a terminal) versus non-interactive origin.")
+	flag.BoolVar(&memOn, "m", false, "sample the memory and I/O usage of the exiting processes (peak RSS, page faults, read/write bytes).")
+	flag.BoolVar(&treeOn, "A", false, "aggregate the exec() events by ancestry chain and display the tree.")
+	flag.BoolVar(&nsOn, "ns", false, "record the pid and mount namespaces of the processes and display the stats per pid namespace (containers).")
+	flag.Var(&attachPids, "p", "only account the exec() of the descendants of this pid (repeatable).")
+	flag.Var(&excludeFilters, "exclude", "ignore exec() events matching this filter (repeatable, see below).")
+	flag.Var(&includeFilters, "include", "only account exec() events matching this filter (repeatable).")
+	flag.Var(&hideFilters, "hide", "hide commands matching this filter from the stats (repeatable).")
+	flag.Var(&subHideFilters, "hide-sub", "hide the subtrees of the commands matching this filter (repeatable).")
+	flag.Var(&showFilters, "show", "only display commands matching this filter in the stats (repeatable).")
+	flag.Var(&rotateSize, "rotate-size", "rotate the output file when it gets bigger than this size (eg: 100M).")
+	flag.DurationVar(&rotateTime, "rotate-time", 0, "rotate the output file when it gets older than this (eg: 24h).")
+	flag.BoolVar(&rotateGzip, "rotate-gzip", false, "compress the rotated output files.")
+	flag.DurationVar(&rotateKeep, "rotate-keep", 0, "remove the rotated (or snapshot) output files older than this (eg: 168h).")
+	flag.BoolVar(&snapshotFiles, "snapshots", false, "write every stats display in its own file (output file name followed by a time stamp).")
+	flag.StringVar(&historyDir, "H", "", "keep a history of the per command counters in this directory (see the history command).")
+	flag.DurationVar(&historyStep, "history-step", time.Minute, "interval between two records of the history.")
+	flag.StringVar(&statsdAddr, "statsd", "", "push the metrics to this StatsD server at every interval (host:port, UDP).")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "trexec.", "prefix of the StatsD metric names.")
+	flag.StringVar(&statsdFormat, "statsd-format", "statsd", "StatsD protocol (statsd or dogstatsd with tags).")
+	flag.Var(&statsdTags, "statsd-tags", "DogStatsD tags (comma separated, repeatable): k:v, hostname (host:name) and cgroup (the cgroup of the commands).")
+	flag.StringVar(&influxURL, "influx-url", "", "also send every stats output to this InfluxDB write URL (line protocol, eg: http://localhost:8086/write?db=trexec).")
+	flag.StringVar(&influxToken, "influx-token", "", "InfluxDB 2 API token (for the /api/v2/write URLs).")
+	flag.StringVar(&otlpEndpoint, "otlp", "", "push the metrics to this OpenTelemetry collector at every interval (eg: http://localhost:4318/v1/metrics or http://localhost:4317 with grpc).")
+	flag.StringVar(&otlpProtocol, "otlp-protocol", "http/protobuf", "OTLP transport (http/protobuf or grpc).")
+	flag.Var(&otlpAttrs, "otlp-attrs", "extra OTLP resource attributes (key=value, comma separated, repeatable).")
+	flag.IntVar(&otlpMaxCmds, "otlp-max-cmds", 100, "maximum number of command.name attribute values (the other commands are accounted as _other).")
+	flag.StringVar(&eventsFn, "events", "", "write a record per exec and exit event to this file (- is stdout).")
+	flag.StringVar(&eventsFormat, "events-format", "json", "event records format (json or logfmt).")
+	flag.IntVar(&eventsSample, "events-sample", 1, "only write 1 exec event out of N (and the exit event of the same processes).")
+	flag.Var(&eventsFilters, "events-filter", "only write the events of the processes matching this filter (repeatable).")
+	flag.StringVar(&httpAddr, "http", "", "serve the web dashboard and JSON API on this address (eg: localhost:8080).")
+	flag.StringVar(&syslogTarget, "syslog", "", "send a summary at every interval to syslog or the journal (journal, unix[:path] or udp:host:port).")
+	flag.Float64Var(&syslogStorm, "syslog-storm", 0, "send an exec storm alert to syslog when the exec rate (per second) of an interval reaches this value.")
+	flag.BoolVar(&daemon, "d", false, "daemon mode: systemd notifications and watchdog, logs to the journal.")
+	flag.StringVar(&pidfn, "pidfile", "", "write our pid to this file.")
+	flag.StringVar(&confn, "C", "", "configuration file (the command line flags override its values).")
 	flag.Parse()
-	switch sortKey {
+	flag.Visit(func(f *flag.Flag) { cmdlineFlags[f.Name] = true })
+	if confn != "" {
+		check(loadConf(confn))
+	}
+	check(applyOpts())
+	check(applyOutputs())
+	if flag.NArg() != 0 {
+		startRun(flag.Args())
+	}
+}
+
+// Set sortCriteria from its name.
+func setSortCriteria(k string) error {
+	switch k {
 	case "count":
 		sortCriteria = scCount
 	case "time":
 		sortCriteria = scTime
+	case "rss":
+		sortCriteria = scRSS
+	case "faults":
+		sortCriteria = scFaults
+	case "io":
+		sortCriteria = scIO
 	default:
-		check(fmt.Errorf("Unknown sort criteria '%s'. Use -s 'count' or 'time'.", sortKey))
+		return fmt.Errorf("Unknown sort criteria '%s'. Use -s 'count', 'time', 'rss', 'faults' or 'io'.", k)
 	}
-	if outfn != "" {
-		var err error
-		out, err = os.Create(outfn)
-		check(err)
-	} else {
-		out = os.Stderr
+	if sortCriteria > scTime && !memOn {
+		return fmt.Errorf("Sort criteria '%s' needs the memory and I/O sampling (-m).", k)
 	}
+	return nil
+}
+
+// Check and apply the options values (at startup and after a configuration reload).
+// Assumes the global maps are locked after a reload.
+func applyOpts() error {
+	if err := setSortCriteria(sortKey); err != nil {
+		return err
+	}
+	switch outFormat {
+	case "text", "json", "influx", "html", "csv":
+	case "pprof":
+		if !treeOn {
+			return fmt.Errorf("The pprof output format needs the ancestry tree (-A).")
+		}
+		if !snapshotFiles && (flag.NArg() == 0 || interval != 0) {
+			return fmt.Errorf("The pprof output format writes a profile per stats display, it needs -snapshots (or the run mode without -i).")
+		}
+	default:
+		return fmt.Errorf("Unknown output format '%s'. Use -f 'text', 'json', 'influx', 'html', 'csv' or 'pprof'.", outFormat)
+	}
+	if err := setRootPids(); err != nil {
+		return err
+	}
+	sendLatest(intervalc, interval)
+	if err := setStatsd(); err != nil {
+		return err
+	}
+	if err := setOtlp(); err != nil {
+		return err
+	}
+	if err := setEvents(); err != nil {
+		return err
+	}
+	if err := setHTTP(); err != nil {
+		return err
+	}
+	return setHistory()
+}
+
+// Apply the options of the outputs that have their own lock (after applyOpts, the global maps not locked).
+func applyOutputs() error {
+	if err := out.setName(outfn); err != nil {
+		return err
+	}
+	return setSyslog() // The sink lock is taken before mutInfos by push().
 }
 
 // Handle signals (output stats).
 func trap() {
 	c := make(chan os.Signal, 1)
 	//signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, os.Interrupt)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
 	for s := range c {
+		if s == syscall.SIGHUP {
+			out.reopen()
+			if events != nil {
+				events.reopen()
+			}
+			reloadConf()
+			continue
+		}
+		if runArgs != nil && (s == syscall.SIGTERM || s == os.Interrupt) {
+			// Run mode, we exit with the command. (The terminal already sent SIGINT to the command.)
+			if s == syscall.SIGTERM && runCmd != nil && runCmd.Process != nil {
+				runCmd.Process.Signal(s)
+			}
+			continue
+		}
 		stats()
 		switch s {
 		case syscall.SIGTERM, os.Interrupt:
-			fmt.Fprintf(out, "Received %s Signal. Exiting.\n", s)
-			os.Exit(0)
+			if outFormat == "text" {
+				fmt.Fprintf(out, "Received %s Signal. Exiting.\n", s)
+			}
+			if daemon {
+				logf(prioNotice, "Received %s Signal. Exiting.", s)
+			}
+			shutdown(0)
+		case syscall.SIGUSR1:
+			pushInflux()
 		case syscall.SIGUSR2:
+			pushInflux()
 			clearCounters()
 		}
 
 	}
 }
 
+// The tick loop gets the (new) interval from here.
+var intervalc = make(chan time.Duration, 1)
+
+// Send a value to the tick loop without blocking: it replaces the pending one (the tick loop may wait for the global maps).
+func sendLatest(c chan time.Duration, d time.Duration) {
+	for {
+		select {
+		case c <- d:
+			return
+		default:
+		}
+		select {
+		case <-c:
+		default:
+		}
+	}
+}
+
 // Output stats periodicaly.
-func tick(i time.Duration) {
-	ticker := time.NewTicker(i)
-	for _ = range ticker.C {
-		stats()
-		if clear {
-			clearCounters()
+func tick() {
+	var ticker *time.Ticker
+	var tc <-chan time.Time // nil (blocks forever) when there is no periodic output.
+	var i time.Duration
+	var hticker *time.Ticker
+	var htc <-chan time.Time // nil without history store.
+	var hi time.Duration
+	for {
+		select {
+		case <-alivec:
+		case ni := <-historyc:
+			if ni == hi {
+				continue
+			}
+			if hticker != nil {
+				hticker.Stop()
+				hticker, htc = nil, nil
+			}
+			if hi = ni; hi != 0 {
+				hticker = time.NewTicker(hi)
+				htc = hticker.C
+			}
+		case <-htc:
+			mutInfos.Lock()
+			h := history
+			mutInfos.Unlock()
+			if h != nil {
+				h.sample()
+			}
+		case ni := <-intervalc:
+			if ni == i {
+				continue
+			}
+			if ticker != nil {
+				ticker.Stop()
+				ticker, tc = nil, nil
+			}
+			if i = ni; i != 0 {
+				ticker = time.NewTicker(i)
+				tc = ticker.C
+			}
+		case <-tc:
+			stats()
+			pushInflux()
+			mutInfos.Lock() // The exporters are replaced by a reload.
+			sd, ot, sl := statsd, otlp, syslogOut
+			mutInfos.Unlock()
+			if sd != nil {
+				sd.push()
+			}
+			if ot != nil {
+				ot.export()
+			}
+			if sl != nil {
+				sl.push()
+			}
+			if clear {
+				clearCounters()
+			}
 		}
 	}
 }
@@ -138,12 +469,29 @@ func tickCPIs(i time.Duration) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			diffMain(os.Args[2:])
+			return
+		case "history":
+			historyMain(os.Args[2:])
+			return
+		case "html":
+			htmlMain(os.Args[2:])
+			return
+		case "pprof":
+			pprofMain(os.Args[2:])
+			return
+		}
+	}
 	parseOpts()
+	startDaemon()
+	scanProc() // Learn about the processes started before us.
 	// Trap sigusr to display stats
 	go trap()
-	if interval != 0 {
-		go tick(interval)
-	}
+	go tick()
 	go tickCPIs(5 * 60 * time.Second) // clean process infos map every 5min
 	getProcEvents()
+	shutdown(1) // Only returns on error.
 }
@@ -0,0 +1,155 @@
+package main
+
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var memOn bool // -m: sample the memory and I/O usage of the exiting processes.
+
+// Memory and I/O usage of a process (or the sum for a command).
+type resUsage struct {
+	n      uint64 // number of sampled processes.
+	nrss   uint64 // number of processes with a peak RSS (not available without taskstats).
+	rss    uint64 // peak resident set size in KB (sum of the peaks for a command).
+	maxrss uint64 // highest peak RSS in KB.
+	minflt uint64 // minor page faults.
+	majflt uint64 // major page faults.
+	rb     uint64 // bytes read from the storage.
+	wb     uint64 // bytes written to the storage.
+	cpu    uint64 // user and system CPU time in ns.
+}
+
+// Add the usage of a process.
+func (r *resUsage) add(p *resUsage) {
+	r.n += p.n
+	r.nrss += p.nrss
+	r.rss += p.rss
+	r.maxrss = umax64(r.maxrss, p.maxrss)
+	r.minflt += p.minflt
+	r.majflt += p.majflt
+	r.rb += p.rb
+	r.wb += p.wb
+	r.cpu += p.cpu
+}
+
+// Value of a resource sort criteria.
+func (r *resUsage) key(sc int) uint64 {
+	switch sc {
+	case scRSS:
+		return r.rss
+	case scFaults:
+		return r.minflt + r.majflt
+	case scIO:
+		return r.rb + r.wb
+	}
+	return 0
+}
+
+// Human readable usage.
+func (r *resUsage) String() string {
+	rss := "-"
+	if r.nrss != 0 {
+		rss = fmt.Sprintf("max %s avg %s", fmtBytes(r.maxrss*1024), fmtBytes(r.rss*1024/r.nrss))
+	}
+	return fmt.Sprintf("rss %s, faults %d/%d, io r %s w %s, cpu %s", rss, r.minflt, r.majflt, fmtBytes(r.rb), fmtBytes(r.wb), time.Duration(r.cpu))
+}
+
+// Format a size in bytes with a binary unit.
+func fmtBytes(b uint64) string {
+	const units = "KMGTPE"
+	if b < 1024 {
+		return strconv.FormatUint(b, 10) + "B"
+	}
+	f := float64(b)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", f, units[i])
+}
+
+//export goTaskStats
+// Called with the taskstats of every exiting thread, just before its exit event.
+func goTaskStats(ctgid C.int, rss, minflt, majflt, rb, wb, cpu C.ulonglong) {
+	mutInfos.Lock()
+	if pi, known := procInfos[int(ctgid)]; known && !pi.skip {
+		r := &pi.res
+		r.n = 1
+		r.nrss = 1
+		r.rss = umax64(r.rss, uint64(rss)) // The peak of the whole process.
+		r.maxrss = r.rss
+		r.minflt += uint64(minflt)
+		r.majflt += uint64(majflt)
+		r.rb += uint64(rb)
+		r.wb += uint64(wb)
+		r.cpu += uint64(cpu) * 1000 // us
+	}
+	mutInfos.Unlock()
+}
+
+// Last chance read of the usage of an exited process (a zombie) when taskstats is not available.
+// The peak RSS is gone with the process memory, the I/O counters include the ones of its reaped children.
+// Assumes the global maps are locked.
+func readExitUsage(pi *procInfo) {
+	p := "/proc/" + strconv.Itoa(pi.pid)
+	s, err := fastRead(p + "/stat")
+	if err != nil {
+		return // Already reaped.
+	}
+	i := bytes.LastIndexByte(s, ')')
+	if i < 0 {
+		return
+	}
+	f := strings.Fields(string(s[i+1:])) // Starts with the field 2 (state).
+	if len(f) < 14 {
+		return
+	}
+	r := &pi.res
+	r.n = 1
+	r.minflt, _ = strconv.ParseUint(f[9-2], 10, 64)
+	r.majflt, _ = strconv.ParseUint(f[11-2], 10, 64)
+	ut, _ := strconv.ParseUint(f[13-2], 10, 64) // utime
+	st, _ := strconv.ParseUint(f[14-2], 10, 64) // stime
+	r.cpu = (ut + st) * uint64(time.Second) / uint64(userHZ)
+	s, err = fastRead(p + "/io")
+	if err != nil {
+		return
+	}
+	for _, l := range strings.Split(string(s), "\n") {
+		if v := strings.TrimPrefix(l, "read_bytes: "); v != l {
+			r.rb, _ = strconv.ParseUint(v, 10, 64)
+		} else if v := strings.TrimPrefix(l, "write_bytes: "); v != l {
+			r.wb, _ = strconv.ParseUint(v, 10, 64)
+		}
+	}
+	// Remove what was already accounted to the exited children.
+	r.rb -= umin64(r.rb, pi.cio.rb)
+	r.wb -= umin64(r.wb, pi.cio.wb)
+	if pi.ppi != nil {
+		pi.ppi.cio.rb += r.rb + pi.cio.rb
+		pi.ppi.cio.wb += r.wb + pi.cio.wb
+	}
+}
+
+// Display the memory and I/O usage of a command (after its exec stats line).
+func statsRes(cmd string, r *resUsage, sub bool) {
+	if r.n == 0 {
+		return
+	}
+	if raw {
+		t := "rs"
+		if sub {
+			t = "rc"
+		}
+		fmt.Fprintf(out, "%s:%s:%d:%d:%d:%d:%d:%d:%d:%d\n", t, cmd, r.n, r.nrss, r.maxrss, r.rss, r.minflt, r.majflt, r.rb, r.wb)
+		return
+	}
+	fmt.Fprintf(out, "    %s\n", r)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var nsOn bool // -ns: record the namespaces of the processes.
+
+// Namespaces of a process.
+type nsIds struct {
+	pidns uint64 // pid namespace inode number.
+	mntns uint64 // mount namespace inode number.
+	nspid int    // pid in its own pid namespace.
+}
+
+// Stats of a pid namespace.
+type nsInfo struct {
+	ino     uint64
+	mntns   uint64            // mount namespace of the last process seen.
+	init    string            // command of the namespace init process (pid 1 in the namespace).
+	initPid int               // host pid of the namespace init process.
+	initNs  int               // pid of the init process in the namespace (1 once seen).
+	ec      uint64            // number of exec() in this namespace.
+	et      uint64            // exec time of the processes of this namespace.
+	cmds    map[string]uint64 // exec count per command.
+}
+
+// For every pid namespace stores its informations.
+var nsInfos = map[uint64](*nsInfo){}
+
+var selfNs nsIds // our namespaces (the host ones unless we run in a container).
+
+func init() {
+	selfNs = readNs(selfPid)
+}
+
+// Inode number of a /proc/[pid]/ns/ file.
+func nsIno(p string) uint64 {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino
+}
+
+// Read the namespaces of a process and its pid in its own pid namespace (last NSpid value in /proc/[pid]/status).
+func readNs(pid int) nsIds {
+	p := "/proc/" + strconv.Itoa(pid)
+	ns := nsIds{pidns: nsIno(p + "/ns/pid"), mntns: nsIno(p + "/ns/mnt"), nspid: pid}
+	s, err := fastRead(p + "/status")
+	if err != nil {
+		return ns
+	}
+	i := strings.Index(string(s), "\nNSpid:")
+	if i < 0 {
+		return ns
+	}
+	l := string(s[i+7:])
+	if j := strings.IndexByte(l, '\n'); j >= 0 {
+		l = l[:j]
+	}
+	if f := strings.Fields(l); len(f) != 0 {
+		if n, err := strconv.Atoi(f[len(f)-1]); err == nil {
+			ns.nspid = n
+		}
+	}
+	return ns
+}
+
+// Name of a pid namespace.
+func nsName(ino uint64) string {
+	if ino == selfNs.pidns {
+		return "host"
+	}
+	return strconv.FormatUint(ino, 10)
+}
+
+// Account an exec() event to its pid namespace.
+// Assumes the global maps are locked.
+func recordNs(pi *procInfo) {
+	pi.ns = readNs(pi.pid)
+	if pi.ns.pidns == 0 {
+		return // Vanished.
+	}
+	ni, known := nsInfos[pi.ns.pidns]
+	if !known {
+		ni = &nsInfo{ino: pi.ns.pidns, cmds: map[string]uint64{}}
+		nsInfos[pi.ns.pidns] = ni
+	}
+	ni.mntns = pi.ns.mntns
+	if pi.ns.nspid == 1 || ni.init == "" {
+		ni.init, ni.initPid, ni.initNs = pi.ci.cmd, pi.pid, pi.ns.nspid
+		if pi.ns.nspid != 1 {
+			ni.initPid = 0 // Not the init, only a name until we see it.
+		}
+	}
+	ni.ec++
+	ni.cmds[pi.ci.cmd]++
+}
+
+// Account the execution time of an exited process to its pid namespace.
+// Assumes the global maps are locked.
+func nsExit(pi *procInfo, et uint64) {
+	if ni, known := nsInfos[pi.ns.pidns]; known {
+		ni.et += et
+	}
+}
+
+// Display the exec stats per pid namespace.
+func statsNs(dts float64) {
+	printSep(out, " top %d pid namespaces sorted by %s ", top, scStrings[execSortCriteria()])
+	type nsCmd struct {
+		cmd string
+		ec  uint64
+	}
+	type nsStat struct {
+		nsInfo
+		top []nsCmd
+	}
+	var nss []*nsStat
+	var set uint64
+	mutInfos.Lock()
+	for _, ni := range nsInfos {
+		set += ni.et
+		ns := &nsStat{nsInfo: *ni}
+		for c, n := range ni.cmds {
+			ns.top = append(ns.top, nsCmd{c, n})
+		}
+		sort.Slice(ns.top, func(i, j int) bool { return ns.top[i].ec > ns.top[j].ec })
+		if len(ns.top) > 3 {
+			ns.top = ns.top[:3]
+		}
+		nss = append(nss, ns)
+	}
+	mutInfos.Unlock()
+	key := func(ns *nsStat) uint64 {
+		if execSortCriteria() == scTime {
+			return ns.et
+		}
+		return ns.ec
+	}
+	sort.Slice(nss, func(i, j int) bool { return key(nss[i]) > key(nss[j]) })
+	for i, ns := range nss {
+		if i >= top {
+			break
+		}
+		ecpc := float32(ns.ec*100) / float32(max64(int64(nbExecEv), 1))
+		etpc := float32(ns.et*100) / float32(max64(int64(set), 1))
+		init := ns.init
+		if ns.initPid != 0 {
+			init = fmt.Sprintf("%s host pid %d", ns.init, ns.initPid)
+		}
+		var cs []string
+		for _, c := range ns.top {
+			cs = append(cs, fmt.Sprintf("%s:%d", c.cmd, c.ec))
+		}
+		if raw {
+			fmt.Fprintf(out, "ns:%s:%d:%s:%.2f:%d:%.2f:%s:%.2f:%s\n", nsName(ns.ino), ns.mntns, init, ecpc, ns.ec, float64(ns.ec)/dts, time.Duration(ns.et), etpc, strings.Join(cs, ","))
+		} else {
+			fmt.Fprintf(out, "%s (%s): %.2f%% (%d) %.2fe/s %s (%.2f%%) %s\n", nsName(ns.ino), init, ecpc, ns.ec, float64(ns.ec)/dts, time.Duration(ns.et), etpc, strings.Join(cs, " "))
+		}
+	}
+}
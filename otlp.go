@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var otlpEndpoint string  // -otlp: OTLP collector URL.
+var otlpProtocol string  // -otlp-protocol: http/protobuf or grpc.
+var otlpAttrs stringList // -otlp-attrs: extra resource attributes (k=v).
+var otlpMaxCmds int      // -otlp-max-cmds: cardinality cap of the command.name attribute.
+
+const otlpScale = 2 // exponential histograms scale: 2^(2^-2) bucket growth factor (about 19%).
+
+const otlpOther = "_other" // command.name of the commands beyond the cardinality cap.
+
+// Exponential histogram of the execution times (in seconds) with the otlpScale.
+type expHist struct {
+	counts map[int]uint64 // bucket index: (base^i, base^(i+1)].
+	zero   uint64
+	count  uint64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+// Account a value.
+func (h *expHist) record(v float64) {
+	if h.counts == nil {
+		h.counts = map[int]uint64{}
+	}
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+	if v <= 0 {
+		h.zero++
+		return
+	}
+	i := int(math.Ceil(math.Log2(v)*(1<<otlpScale))) - 1
+	h.counts[i]++
+}
+
+// Add the values of another histogram.
+func (h *expHist) merge(o *expHist) {
+	if o == nil || o.count == 0 {
+		return
+	}
+	if h.counts == nil {
+		h.counts = map[int]uint64{}
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+	h.zero += o.zero
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+}
+
+var procHist expHist // execution time distribution of all the processes (-otlp).
+
+// The OTLP exporter.
+type otlpExporter struct {
+	endpoint string
+	grpc     bool
+	client   *http.Client
+	res      [][2]string     // resource attributes.
+	cmds     map[string]bool // commands with their own command.name (the others are accounted as _other).
+	start    time.Time       // start of the accounted cmds (they are forgotten after a clear).
+	mut      sync.Mutex
+	nbError  int
+}
+
+var otlp *otlpExporter
+
+func init() {
+	atExit(func() {
+		if otlp != nil {
+			otlp.export()
+		}
+	})
+}
+
+// Create, change or remove the OTLP exporter (at startup and after a configuration reload).
+// Assumes the global maps are locked after a reload.
+func setOtlp() error {
+	if otlpEndpoint == "" {
+		otlp = nil
+		return nil
+	}
+	if interval == 0 {
+		return fmt.Errorf("The OTLP exporter pushes the metrics at every interval, -otlp needs -i.")
+	}
+	u, err := url.Parse(otlpEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Invalid OTLP endpoint '%s' (eg: http://localhost:4318/v1/metrics).", otlpEndpoint)
+	}
+	e := &otlpExporter{endpoint: otlpEndpoint, cmds: map[string]bool{}, start: start}
+	switch otlpProtocol {
+	case "http/protobuf":
+		e.client = &http.Client{Timeout: 10 * time.Second}
+	case "grpc":
+		// gRPC is HTTP/2 (cleartext with prior knowledge for http://).
+		e.grpc = true
+		var p http.Protocols
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+		e.client = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{Protocols: &p}}
+		e.endpoint = strings.TrimRight(otlpEndpoint, "/") + "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	default:
+		return fmt.Errorf("Unknown OTLP protocol '%s'. Use -otlp-protocol 'http/protobuf' or 'grpc'.", otlpProtocol)
+	}
+	hn, _ := os.Hostname()
+	e.res = [][2]string{{"service.name", "trexec"}, {"host.name", hn}}
+	for _, a := range otlpAttrs {
+		i := strings.IndexByte(a, '=')
+		if i <= 0 {
+			return fmt.Errorf("Invalid OTLP resource attribute '%s' (expecting key=value).", a)
+		}
+		e.res = append(e.res, [2]string{a[:i], a[i+1:]})
+	}
+	if otlp != nil && otlp.endpoint == e.endpoint {
+		e.cmds = otlp.cmds // Keep the series of the commands.
+	}
+	otlp = e
+	return nil
+}
+
+// Encode an attribute (string value).
+func pbAttr(m *pbuf, f int, k, v string) {
+	m.msg(f, func(kv *pbuf) {
+		kv.str(1, k)
+		kv.msg(2, func(av *pbuf) { av.str(1, v) })
+	})
+}
+
+// Counters of a command at export time.
+type otlpCmd struct {
+	name  string
+	ec    uint64
+	et    uint64
+	subec uint64
+	xh    expHist
+}
+
+// Encode an ExportMetricsServiceRequest with the current counters (cumulative since start).
+func (e *otlpExporter) request() []byte {
+	mutInfos.Lock()
+	st, now := uint64(start.UnixNano()), uint64(time.Now().UnixNano())
+	if !start.Equal(e.start) {
+		e.cmds, e.start = map[string]bool{}, start // Counters cleared, new series.
+	}
+	exec, exit, drop := nbExecEv, nbExitEv, nbDroppedEv
+	var fwoe uint64
+	if nbforkev > exec+drop {
+		fwoe = nbforkev - exec - drop
+	}
+	ph := procHist
+	ph.counts = map[int]uint64{}
+	for i, n := range procHist.counts {
+		ph.counts[i] = n
+	}
+	var cs []*otlpCmd
+	for _, ci := range cmdInfos {
+		if (ci.ec == 0 && ci.et == 0 && ci.subec == 0) || !reportAccept(ci) {
+			continue
+		}
+		c := &otlpCmd{name: ci.cmd, ec: ci.ec, et: ci.et, subec: ci.subec}
+		if c.name == "" {
+			c.name = "(vanished)"
+		}
+		if ci.xh != nil {
+			c.xh.merge(ci.xh)
+		}
+		cs = append(cs, c)
+	}
+	mutInfos.Unlock()
+	// The most exec()ed commands get their own series, first come first served to keep the series stable.
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ec > cs[j].ec })
+	other := &otlpCmd{name: otlpOther}
+	var kept []*otlpCmd
+	for _, c := range cs {
+		if !e.cmds[c.name] && len(e.cmds) < otlpMaxCmds {
+			e.cmds[c.name] = true
+		}
+		if !e.cmds[c.name] {
+			other.ec += c.ec
+			other.et += c.et
+			other.subec += c.subec
+			other.xh.merge(&c.xh)
+			continue
+		}
+		kept = append(kept, c)
+	}
+	if other.ec != 0 || other.et != 0 || other.subec != 0 {
+		kept = append(kept, other)
+	}
+
+	// Number data point of a cumulative sum.
+	point := func(m *pbuf, attr string, i uint64, d float64, isInt bool) {
+		m.msg(1, func(p *pbuf) {
+			if attr != "" {
+				pbAttr(p, 7, "command.name", attr)
+			}
+			p.fixed64(2, st)
+			p.fixed64(3, now)
+			if isInt {
+				p.fixed64(6, i)
+			} else {
+				p.double(4, d)
+			}
+		})
+	}
+	// Monotonic cumulative sum metric.
+	sum := func(m *pbuf, name, desc, unit string, points func(s *pbuf)) {
+		m.msg(2, func(mt *pbuf) {
+			mt.str(1, name)
+			mt.str(2, desc)
+			mt.str(3, unit)
+			mt.msg(7, func(s *pbuf) {
+				points(s)
+				s.uint(2, 2) // AGGREGATION_TEMPORALITY_CUMULATIVE
+				s.bool(3, true)
+			})
+		})
+	}
+	histPoint := func(m *pbuf, attr string, h *expHist) {
+		m.msg(1, func(p *pbuf) {
+			if attr != "" {
+				pbAttr(p, 1, "command.name", attr)
+			}
+			p.fixed64(2, st)
+			p.fixed64(3, now)
+			p.fixed64(4, h.count)
+			p.double(5, h.sum)
+			p.sint(6, otlpScale)
+			p.fixed64(7, h.zero)
+			if len(h.counts) != 0 {
+				lo, hi := math.MaxInt32, math.MinInt32
+				for i := range h.counts {
+					if i < lo {
+						lo = i
+					}
+					if i > hi {
+						hi = i
+					}
+				}
+				bc := make([]uint64, hi-lo+1)
+				for i, n := range h.counts {
+					bc[i-lo] = n
+				}
+				p.msg(8, func(b *pbuf) {
+					b.sint(1, int64(lo))
+					b.packed(2, bc)
+				})
+			}
+			if h.count != 0 {
+				p.double(12, h.min)
+				p.double(13, h.max)
+			}
+		})
+	}
+
+	var req pbuf
+	req.msg(1, func(rm *pbuf) {
+		rm.msg(1, func(r *pbuf) {
+			for _, a := range e.res {
+				pbAttr(r, 1, a[0], a[1])
+			}
+		})
+		rm.msg(2, func(sm *pbuf) {
+			sm.msg(1, func(s *pbuf) { s.str(1, "trexec") })
+			sum(sm, "trexec.exec", "Number of exec() calls.", "{exec}", func(s *pbuf) { point(s, "", exec, 0, true) })
+			sum(sm, "trexec.forks_without_exec", "Number of fork() not followed by an exec().", "{fork}", func(s *pbuf) { point(s, "", fwoe, 0, true) })
+			sum(sm, "trexec.exit", "Number of exited processes.", "{process}", func(s *pbuf) { point(s, "", exit, 0, true) })
+			sum(sm, "trexec.filtered_out", "Number of exec() calls dropped by the filters.", "{exec}", func(s *pbuf) { point(s, "", drop, 0, true) })
+			sum(sm, "trexec.command.exec", "Number of exec() calls per command.", "{exec}", func(s *pbuf) {
+				for _, c := range kept {
+					point(s, c.name, c.ec, 0, true)
+				}
+			})
+			sum(sm, "trexec.command.duration", "Wall clock execution time of the exited processes per command.", "s", func(s *pbuf) {
+				for _, c := range kept {
+					point(s, c.name, 0, float64(c.et)/1e9, false)
+				}
+			})
+			sum(sm, "trexec.command.sub_exec", "Number of exec() calls of the descendants per command.", "{exec}", func(s *pbuf) {
+				for _, c := range kept {
+					point(s, c.name, c.subec, 0, true)
+				}
+			})
+			sm.msg(2, func(mt *pbuf) {
+				mt.str(1, "trexec.process.duration")
+				mt.str(2, "Wall clock execution time distribution of the exited processes.")
+				mt.str(3, "s")
+				mt.msg(10, func(x *pbuf) {
+					histPoint(x, "", &ph)
+					for _, c := range kept {
+						if c.xh.count != 0 {
+							histPoint(x, c.name, &c.xh)
+						}
+					}
+					x.uint(2, 2)
+				})
+			})
+		})
+	})
+	return req
+}
+
+// Send the metrics to the collector.
+func (e *otlpExporter) export() {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	body := e.request()
+	ct := "application/x-protobuf"
+	if e.grpc {
+		// Length-prefixed message (not compressed).
+		body = append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(body))), body...)
+		ct = "application/grpc"
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		e.error(err)
+		return
+	}
+	req.Header.Set("Content-Type", ct)
+	if e.grpc {
+		req.Header.Set("TE", "trailers")
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.error(err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16)) // The gRPC trailers come after the body.
+	if resp.StatusCode/100 != 2 {
+		e.error(fmt.Errorf("%s", resp.Status))
+		return
+	}
+	if e.grpc {
+		// The status is in the trailers (or in the headers for an immediate error).
+		gs, gm := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+		if gs == "" {
+			gs, gm = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+		}
+		if gs != "0" {
+			e.error(fmt.Errorf("grpc status %s %s", gs, gm))
+			return
+		}
+	}
+	e.nbError = 0
+}
+
+// Report the export errors (only the first one of a series).
+func (e *otlpExporter) error(err error) {
+	if e.nbError == 0 {
+		logf(prioWarning, "otlp: %s", err)
+	}
+	e.nbError++
+}
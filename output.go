@@ -0,0 +1,233 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rotateSize sizeValue     // rotate the output file when it gets bigger than this.
+var rotateTime time.Duration // rotate the output file when it gets older than this.
+var rotateGzip bool          // compress the rotated files.
+var rotateKeep time.Duration // remove the rotated files older than this.
+var snapshotFiles bool       // one output file per stats display.
+
+const rotateStamp = "20060102-150405.000000000" // time stamp added to the rotated (or snapshot) files names (unique, even several per second).
+
+// A size in bytes with an optional k, M, G or T suffix.
+type sizeValue int64
+
+func (s *sizeValue) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeValue) Set(v string) error {
+	m := int64(1)
+	if l := len(v); l > 0 {
+		if i := strings.IndexByte("kMGT", v[l-1]); i >= 0 {
+			m = 1 << (10 * uint(i+1))
+			v = v[:l-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size '%s' (eg: 512k, 100M, 1G)", v)
+	}
+	*s = sizeValue(n * m)
+	return nil
+}
+
+// The stats output (stderr or a file with optional rotation).
+type outFile struct {
+	fn     string // file name, "" for stderr.
+	f      *os.File
+	size   int64     // bytes in the current file.
+	opened time.Time // when the current file was created.
+	mut    sync.Mutex
+}
+
+var out = &outFile{f: os.Stderr}
+
+var gzipping sync.WaitGroup // files being compressed.
+
+func init() {
+	atExit(gzipping.Wait)
+}
+
+func (o *outFile) Write(b []byte) (int, error) {
+	if o.f == nil {
+		// Between two snapshot files.
+		return os.Stderr.Write(b)
+	}
+	n, err := o.f.Write(b)
+	o.size += int64(n)
+	return n, err
+}
+
+// Open the current file (append if it exists).
+func (o *outFile) open(fn string) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if outFormat == "pprof" {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC // A profile is a whole file.
+	}
+	f, err := os.OpenFile(fn, flags, 0644)
+	if err != nil {
+		return err
+	}
+	o.f = f
+	o.size = 0
+	o.opened = time.Now()
+	if fi, err := f.Stat(); err == nil {
+		o.size = fi.Size()
+		if o.size != 0 {
+			o.opened = fi.ModTime()
+		}
+	}
+	return nil
+}
+
+func (o *outFile) close() {
+	if o.f != nil && o.f != os.Stderr {
+		o.f.Close()
+	}
+	o.f = nil
+}
+
+// Switch to another file name ("" is stderr).
+func (o *outFile) setName(fn string) error {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if fn == o.fn && (o.f != nil) == (fn == "" || !snapshotFiles) {
+		return nil
+	}
+	o.close()
+	o.fn = fn
+	if fn == "" {
+		o.f = os.Stderr
+		return nil
+	}
+	if snapshotFiles {
+		return nil // Opened for each snapshot.
+	}
+	if err := o.open(fn); err != nil {
+		o.f = os.Stderr
+		return err
+	}
+	return nil
+}
+
+// Close and reopen the file (SIGHUP, after logrotate moved it).
+func (o *outFile) reopen() {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if o.fn == "" || snapshotFiles {
+		return
+	}
+	o.close()
+	if err := o.open(o.fn); err != nil {
+		logf(prioErr, "%s", err)
+		o.f = os.Stderr
+	}
+}
+
+// Called before writing the stats: open the snapshot file or rotate the current file if needed.
+// A stats display is never split between two files.
+func (o *outFile) beginStats() {
+	o.mut.Lock()
+	if o.fn == "" {
+		return
+	}
+	now := time.Now()
+	if snapshotFiles {
+		if err := o.open(o.fn + "." + now.Format(rotateStamp)); err != nil {
+			logf(prioErr, "%s", err)
+		}
+		return
+	}
+	if (rotateSize != 0 && o.size >= int64(rotateSize)) || (rotateTime != 0 && now.Sub(o.opened) >= rotateTime) {
+		o.rotate(now)
+	}
+}
+
+// Called after writing the stats.
+func (o *outFile) endStats() {
+	if snapshotFiles && o.fn != "" && o.f != nil {
+		fn := o.f.Name()
+		o.close()
+		if rotateGzip {
+			gzipping.Add(1)
+			go gzipFile(fn)
+		}
+		o.clean()
+	}
+	o.mut.Unlock()
+}
+
+// Move the current file aside and start a new one.
+func (o *outFile) rotate(now time.Time) {
+	o.close()
+	rfn := o.fn + "." + now.Format(rotateStamp)
+	if err := os.Rename(o.fn, rfn); err != nil {
+		logf(prioErr, "%s", err)
+	} else if rotateGzip {
+		gzipping.Add(1)
+		go gzipFile(rfn)
+	}
+	if err := o.open(o.fn); err != nil {
+		logf(prioErr, "%s", err)
+		o.f = os.Stderr
+	}
+	o.clean()
+}
+
+// Remove the rotated (or snapshot) files older than rotateKeep.
+func (o *outFile) clean() {
+	if rotateKeep == 0 {
+		return
+	}
+	fns, _ := filepath.Glob(o.fn + ".[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]-[0-9][0-9][0-9][0-9][0-9][0-9]*")
+	lim := time.Now().Add(-rotateKeep)
+	for _, fn := range fns {
+		if fi, err := os.Stat(fn); err == nil && fi.ModTime().Before(lim) {
+			os.Remove(fn)
+		}
+	}
+}
+
+// Compress a file (fn.gz) and remove the original.
+func gzipFile(fn string) {
+	defer gzipping.Done()
+	f, err := os.Open(fn)
+	if err != nil {
+		logf(prioErr, "%s", err)
+		return
+	}
+	defer f.Close()
+	gf, err := os.Create(fn + ".gz")
+	if err != nil {
+		logf(prioErr, "%s", err)
+		return
+	}
+	zw := gzip.NewWriter(gf)
+	_, err = io.Copy(zw, f)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = gf.Close()
+	} else {
+		gf.Close()
+	}
+	if err != nil {
+		logf(prioErr, "%s", err)
+		os.Remove(fn + ".gz")
+		return
+	}
+	os.Remove(fn)
+}
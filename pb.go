@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Minimal protocol buffers encoder (enough for the OTLP and pprof exports).
+type pbuf []byte
+
+// Wire types.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+)
+
+func (b *pbuf) varint(v uint64) {
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *pbuf) key(f int, wt int) {
+	b.varint(uint64(f)<<3 | uint64(wt))
+}
+
+// Unsigned (or int64 two's complement) varint field.
+func (b *pbuf) uint(f int, v uint64) {
+	b.key(f, pbVarint)
+	b.varint(v)
+}
+
+// Signed zigzag encoded varint field (sint32, sint64).
+func (b *pbuf) sint(f int, v int64) {
+	b.key(f, pbVarint)
+	b.varint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (b *pbuf) bool(f int, v bool) {
+	if v {
+		b.uint(f, 1)
+	} else {
+		b.uint(f, 0)
+	}
+}
+
+// fixed64 and sfixed64 fields.
+func (b *pbuf) fixed64(f int, v uint64) {
+	b.key(f, pbFixed64)
+	*b = binary.LittleEndian.AppendUint64(*b, v)
+}
+
+func (b *pbuf) double(f int, v float64) {
+	b.fixed64(f, math.Float64bits(v))
+}
+
+func (b *pbuf) bytes(f int, v []byte) {
+	b.key(f, pbBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *pbuf) str(f int, s string) {
+	b.key(f, pbBytes)
+	b.varint(uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+// Embedded message field.
+func (b *pbuf) msg(f int, enc func(m *pbuf)) {
+	var m pbuf
+	enc(&m)
+	b.bytes(f, m)
+}
+
+// Packed repeated varint field.
+func (b *pbuf) packed(f int, vs []uint64) {
+	var m pbuf
+	for _, v := range vs {
+		m.varint(v)
+	}
+	b.bytes(f, m)
+}
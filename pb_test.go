@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPbuf(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  func(b *pbuf)
+		want []byte
+	}{
+		{"uint", func(b *pbuf) { b.uint(1, 150) }, []byte{0x08, 0x96, 0x01}},
+		{"uint zero", func(b *pbuf) { b.uint(1, 0) }, []byte{0x08, 0x00}},
+		{"uint big field", func(b *pbuf) { b.uint(16, 1) }, []byte{0x80, 0x01, 0x01}},
+		{"sint -1", func(b *pbuf) { b.sint(1, -1) }, []byte{0x08, 0x01}},
+		{"sint 1", func(b *pbuf) { b.sint(1, 1) }, []byte{0x08, 0x02}},
+		{"sint -2", func(b *pbuf) { b.sint(1, -2) }, []byte{0x08, 0x03}},
+		{"bool", func(b *pbuf) { b.bool(2, true); b.bool(3, false) }, []byte{0x10, 0x01, 0x18, 0x00}},
+		{"fixed64", func(b *pbuf) { b.fixed64(1, 1) }, []byte{0x09, 1, 0, 0, 0, 0, 0, 0, 0}},
+		{"double", func(b *pbuf) { b.double(1, 1) }, []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{"str", func(b *pbuf) { b.str(2, "testing") }, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{"bytes", func(b *pbuf) { b.bytes(2, []byte{1, 2}) }, []byte{0x12, 0x02, 1, 2}},
+		{"msg", func(b *pbuf) { b.msg(3, func(m *pbuf) { m.uint(1, 150) }) }, []byte{0x1a, 0x03, 0x08, 0x96, 0x01}},
+		{"empty msg", func(b *pbuf) { b.msg(3, func(m *pbuf) {}) }, []byte{0x1a, 0x00}},
+		{"packed", func(b *pbuf) { b.packed(4, []uint64{3, 270, 86942}) }, []byte{0x22, 0x06, 0x03, 0x8e, 0x02, 0x9e, 0xa7, 0x05}},
+		{"otlp attribute", func(b *pbuf) { pbAttr(b, 1, "k", "v") }, []byte{0x0a, 0x08, 0x0a, 0x01, 'k', 0x12, 0x03, 0x0a, 0x01, 'v'}},
+	}
+	for _, tt := range tests {
+		var b pbuf
+		tt.enc(&b)
+		if !bytes.Equal(b, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, []byte(b), tt.want)
+		}
+	}
+}
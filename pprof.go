@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// Build a gzipped pprof profile (profile.proto) of an ancestry tree: every node is a "stack" of commands (the leaf first).
+// The sample values are the exec() count, the wall clock execution time and the CPU time (with -m).
+func pprofProfile(s *snapshot) ([]byte, error) {
+	if s.Tree == nil {
+		return nil, fmt.Errorf("No ancestry tree in the snapshot (it needs -A).")
+	}
+	strs := map[string]int{"": 0} // string table indexes.
+	str := func(v string) uint64 {
+		i, known := strs[v]
+		if !known {
+			i = len(strs)
+			strs[v] = i
+		}
+		return uint64(i)
+	}
+	funcs := map[string]uint64{} // command -> function (and location) id.
+	var p pbuf
+	var hasCPU func(t *treeSnapshot) bool
+	hasCPU = func(t *treeSnapshot) bool {
+		for i := range t.Kids {
+			if t.Kids[i].CPU != 0 || hasCPU(&t.Kids[i]) {
+				return true
+			}
+		}
+		return false
+	}
+	cpu := hasCPU(s.Tree)
+	valueType := func(f int, typ, unit string) {
+		p.msg(f, func(m *pbuf) {
+			m.uint(1, str(typ))
+			m.uint(2, str(unit))
+		})
+	}
+	valueType(1, "exec", "count")
+	valueType(1, "wall", "nanoseconds")
+	if cpu {
+		valueType(1, "cpu", "nanoseconds")
+	}
+	var stack []uint64 // location ids, root first.
+	var walk func(t *treeSnapshot)
+	walk = func(t *treeSnapshot) {
+		for i := range t.Kids {
+			k := &t.Kids[i]
+			id, known := funcs[k.Cmd]
+			if !known {
+				id = uint64(len(funcs) + 1)
+				funcs[k.Cmd] = id
+			}
+			stack = append(stack, id)
+			if k.Exec != 0 || k.Time != 0 {
+				p.msg(2, func(m *pbuf) {
+					locs := make([]uint64, len(stack))
+					for j := range stack {
+						locs[j] = stack[len(stack)-1-j]
+					}
+					m.packed(1, locs)
+					vs := []uint64{k.Exec, k.Time}
+					if cpu {
+						vs = append(vs, k.CPU)
+					}
+					m.packed(2, vs)
+				})
+			}
+			walk(k)
+			stack = stack[:len(stack)-1]
+		}
+	}
+	walk(s.Tree)
+	// One location and one function per command.
+	ids := make([]string, len(funcs)+1)
+	for c, id := range funcs {
+		ids[id] = c
+	}
+	for id := uint64(1); id < uint64(len(ids)); id++ {
+		p.msg(4, func(m *pbuf) {
+			m.uint(1, id)
+			m.msg(4, func(l *pbuf) { l.uint(1, id) })
+		})
+	}
+	for id := uint64(1); id < uint64(len(ids)); id++ {
+		p.msg(5, func(m *pbuf) {
+			m.uint(1, id)
+			m.uint(2, str(ids[id]))
+			m.uint(3, str(ids[id]))
+		})
+	}
+	// The strings used after this point must already be in the table.
+	typ, unit := str("exec"), str("count")
+	strTable := make([]string, len(strs))
+	for v, i := range strs {
+		strTable[i] = v
+	}
+	for _, v := range strTable {
+		p.str(6, v)
+	}
+	p.uint(9, uint64(s.Start.UnixNano()))
+	p.uint(10, uint64(s.Duration))
+	p.msg(11, func(m *pbuf) {
+		m.uint(1, typ)
+		m.uint(2, unit)
+	})
+	p.uint(12, 1)
+	p.uint(14, typ)
+	var b bytes.Buffer
+	z := gzip.NewWriter(&b)
+	z.Write(p)
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Output the stats as a pprof profile.
+func statsPprof() {
+	b, err := pprofProfile(takeSnapshot())
+	if err != nil {
+		logf(prioErr, "pprof: %s", err)
+		return
+	}
+	out.Write(b)
+}
+
+func pprofMain(args []string) {
+	fs := flag.NewFlagSet("pprof", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s pprof [-o profile.pb.gz] snapshot.json\n", path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nConvert the ancestry tree of a snapshot saved with -A -f json (the last snapshot of the file is used) into a pprof profile.\n")
+	}
+	ofn := fs.String("o", "", "profile file (default is stdout).")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	s, err := readSnapshot(fs.Arg(0))
+	check(err)
+	b, err := pprofProfile(s)
+	check(err)
+	var w io.WriteCloser = os.Stdout
+	if *ofn != "" {
+		w, err = os.Create(*ofn)
+		check(err)
+	}
+	_, err = w.Write(b)
+	check(err)
+	check(w.Close())
+}
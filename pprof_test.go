@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A decoded protobuf field: a varint or the bytes of a length delimited field.
+type pbField struct {
+	num int
+	v   uint64
+	b   []byte
+}
+
+func pbDecode(t *testing.T, b []byte) []pbField {
+	var fs []pbField
+	for len(b) != 0 {
+		k, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid key")
+		}
+		b = b[n:]
+		f := pbField{num: int(k >> 3)}
+		switch k & 7 {
+		case 0:
+			f.v, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("field %d: invalid varint", f.num)
+			}
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("field %d: invalid length", f.num)
+			}
+			f.b, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", f.num, k&7)
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+func pbPacked(t *testing.T, b []byte) []uint64 {
+	var vs []uint64
+	for len(b) != 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid packed varint")
+		}
+		vs, b = append(vs, v), b[n:]
+	}
+	return vs
+}
+
+// Decode a gzipped profile: the sample types, the samples by stack (leaf first) and the scalar fields.
+func pprofDecode(t *testing.T, z []byte) ([]string, map[string][]uint64, map[int]uint64) {
+	zr, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	var types, samples, locs, funcs [][]byte
+	scalars := map[int]uint64{}
+	var period []byte
+	for _, f := range pbDecode(t, b) {
+		switch f.num {
+		case 1:
+			types = append(types, f.b)
+		case 2:
+			samples = append(samples, f.b)
+		case 4:
+			locs = append(locs, f.b)
+		case 5:
+			funcs = append(funcs, f.b)
+		case 6:
+			strs = append(strs, string(f.b))
+		case 9, 10, 12, 14:
+			scalars[f.num] = f.v
+		case 11:
+			period = f.b
+		default:
+			t.Errorf("unexpected field %d", f.num)
+		}
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("the string table must start with an empty string: %q", strs)
+	}
+	str := func(i uint64) string {
+		if i >= uint64(len(strs)) {
+			t.Fatalf("string index %d out of the table", i)
+		}
+		return strs[i]
+	}
+	valueType := func(b []byte) string {
+		var typ, unit string
+		for _, f := range pbDecode(t, b) {
+			switch f.num {
+			case 1:
+				typ = str(f.v)
+			case 2:
+				unit = str(f.v)
+			}
+		}
+		return typ + "/" + unit
+	}
+	var gotTypes []string
+	for _, b := range types {
+		gotTypes = append(gotTypes, valueType(b))
+	}
+	if got := valueType(period); got != "exec/count" {
+		t.Errorf("period type: got %q", got)
+	}
+	// Function id -> name.
+	names := map[uint64]string{}
+	for _, b := range funcs {
+		var id uint64
+		var name, sys string
+		for _, f := range pbDecode(t, b) {
+			switch f.num {
+			case 1:
+				id = f.v
+			case 2:
+				name = str(f.v)
+			case 3:
+				sys = str(f.v)
+			}
+		}
+		if id == 0 || name != sys || names[id] != "" {
+			t.Errorf("function %d: name %q system name %q", id, name, sys)
+		}
+		names[id] = name
+	}
+	// Location id -> function id.
+	lfuncs := map[uint64]uint64{}
+	for _, b := range locs {
+		var id uint64
+		for _, f := range pbDecode(t, b) {
+			switch f.num {
+			case 1:
+				id = f.v
+			case 4:
+				for _, lf := range pbDecode(t, f.b) {
+					if lf.num == 1 {
+						lfuncs[id] = lf.v
+					}
+				}
+			}
+		}
+	}
+	got := map[string][]uint64{}
+	for _, b := range samples {
+		var stack []string
+		var vs []uint64
+		for _, f := range pbDecode(t, b) {
+			switch f.num {
+			case 1:
+				for _, l := range pbPacked(t, f.b) {
+					stack = append(stack, names[lfuncs[l]])
+				}
+			case 2:
+				vs = pbPacked(t, f.b)
+			}
+		}
+		got[strings.Join(stack, ";")] = vs
+	}
+	if len(names) != len(lfuncs) {
+		t.Errorf("got %d functions and %d locations, want one of each per command", len(names), len(lfuncs))
+	}
+	return gotTypes, got, scalars
+}
+
+func TestPprofProfile(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := &snapshot{Start: start, Duration: int64(time.Minute), Tree: &treeSnapshot{Kids: []treeSnapshot{
+		{Cmd: "cron", Kids: []treeSnapshot{
+			{Cmd: "sh", Exec: 3, Time: 30, Kids: []treeSnapshot{{Cmd: "ls", Exec: 2, Time: 20}}},
+			{Cmd: "ls", Exec: 1, Time: 10},
+		}},
+	}}}
+	z, err := pprofProfile(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, samples, scalars := pprofDecode(t, z)
+	if want := []string{"exec/count", "wall/nanoseconds"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("sample types: got %q, want %q", types, want)
+	}
+	if want := map[int]uint64{9: uint64(start.UnixNano()), 10: uint64(time.Minute), 12: 1, 14: 1}; !reflect.DeepEqual(scalars, want) {
+		t.Errorf("got %v, want %v", scalars, want)
+	}
+	// The leaf first, no sample for the nodes without exec() nor time.
+	want := map[string][]uint64{"sh;cron": {3, 30}, "ls;sh;cron": {2, 20}, "ls;cron": {1, 10}}
+	if !reflect.DeepEqual(samples, want) {
+		t.Errorf("samples: got %v, want %v", samples, want)
+	}
+}
+
+func TestPprofProfileCPU(t *testing.T) {
+	// With -m the CPU time is a third sample value.
+	s := &snapshot{Tree: &treeSnapshot{Kids: []treeSnapshot{{Cmd: "sh", Exec: 1, Time: 10, Kids: []treeSnapshot{{Cmd: "ls", Exec: 1, Time: 5, CPU: 2}}}}}}
+	z, err := pprofProfile(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, samples, _ := pprofDecode(t, z)
+	if want := []string{"exec/count", "wall/nanoseconds", "cpu/nanoseconds"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("sample types: got %q, want %q", types, want)
+	}
+	if want := map[string][]uint64{"sh": {1, 10, 0}, "ls;sh": {1, 5, 2}}; !reflect.DeepEqual(samples, want) {
+		t.Errorf("samples: got %v, want %v", samples, want)
+	}
+}
+
+func TestPprofProfileNoTree(t *testing.T) {
+	if _, err := pprofProfile(&snapshot{}); err == nil {
+		t.Errorf("no error without an ancestry tree")
+	}
+}
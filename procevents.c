@@ -2,6 +2,10 @@
 #include <linux/netlink.h>
 #include <linux/connector.h>
 #include <linux/cn_proc.h>
+#include <linux/genetlink.h>
+#include <linux/taskstats.h>
+#include <poll.h>
+#include <stddef.h>
 #include <signal.h>
 #include <errno.h>
 #include <stdbool.h>
@@ -13,7 +17,9 @@
 /* Go handlers for process events. */
 extern void goProcEventFork(int, int, unsigned long);
 extern void goProcEventExec(int, unsigned long,unsigned long,unsigned long);
-extern void goProcEventExit(int, unsigned long);
+extern void goProcEventExit(int, unsigned long, int);
+extern void goProcEventsReady();
+extern void goTaskStats(int, unsigned long long, unsigned long long, unsigned long long, unsigned long long, unsigned long long, unsigned long long);
 
 // TODO direct access to these variables from Go? (had duplicate declaration error durint my tests)
 static unsigned long nbforkev=0; // count fork events
@@ -78,7 +84,147 @@ static int set_proc_ev_listen(int nl_sock, bool enable)
 }
 
 
-static int handle_proc_ev(int nl_sock)
+/* Generic netlink attributes helpers. */
+#define GENLMSG_DATA(glh) ((void *)((char *)NLMSG_DATA(glh) + GENL_HDRLEN))
+#define NLA_DATA(na) ((void *)((char *)(na) + NLA_HDRLEN))
+#define NLA_NEXT(na) ((struct nlattr *)((char *)(na) + NLA_ALIGN((na)->nla_len)))
+
+/* Send a generic netlink command with a single attribute. */
+static int genl_send(int sock, __u16 type, __u8 cmd, __u16 attr, void *data, int len)
+{
+  struct {
+    struct nlmsghdr n;
+    struct genlmsghdr g;
+    char buf[256];
+  } msg;
+  struct nlattr *na;
+
+  memset(&msg, 0, sizeof(msg));
+  msg.n.nlmsg_len = NLMSG_LENGTH(GENL_HDRLEN);
+  msg.n.nlmsg_type = type;
+  msg.n.nlmsg_flags = NLM_F_REQUEST;
+  msg.n.nlmsg_pid = getpid();
+  msg.g.cmd = cmd;
+  msg.g.version = 1;
+  na = (struct nlattr *)GENLMSG_DATA(&msg);
+  na->nla_type = attr;
+  na->nla_len = NLA_HDRLEN + len;
+  memcpy(NLA_DATA(na), data, len);
+  msg.n.nlmsg_len += NLA_ALIGN(na->nla_len);
+  if (send(sock, &msg, msg.n.nlmsg_len, 0) == -1) {
+    perror("taskstats send");
+    return -1;
+  }
+  return 0;
+}
+
+/*
+ Connect to the kernel taskstats interface and register to get the stats of every exiting task.
+ Returns the socket or -1 (the kernel may not support taskstats).
+*/
+static int ts_connect()
+{
+  int sock, rc, len;
+  struct sockaddr_nl sa;
+  struct {
+    struct nlmsghdr n;
+    struct genlmsghdr g;
+    char buf[1024];
+  } ans;
+  struct nlattr *na;
+  __u16 family = 0;
+  char mask[32];
+  int rcvbuf = 4 * 1024 * 1024;
+
+  sock = socket(AF_NETLINK, SOCK_RAW, NETLINK_GENERIC);
+  if (sock == -1) {
+    perror("taskstats socket");
+    return -1;
+  }
+  memset(&sa, 0, sizeof(sa));
+  sa.nl_family = AF_NETLINK;
+  if (bind(sock, (struct sockaddr *)&sa, sizeof(sa)) == -1) {
+    perror("taskstats bind");
+    close(sock);
+    return -1;
+  }
+  setsockopt(sock, SOL_SOCKET, SO_RCVBUF, &rcvbuf, sizeof(rcvbuf));
+
+  // Get the taskstats family id.
+  if (genl_send(sock, GENL_ID_CTRL, CTRL_CMD_GETFAMILY, CTRL_ATTR_FAMILY_NAME, TASKSTATS_GENL_NAME, strlen(TASKSTATS_GENL_NAME) + 1) == -1) {
+    close(sock);
+    return -1;
+  }
+  rc = recv(sock, &ans, sizeof(ans), 0);
+  if (rc == -1 || !NLMSG_OK(&ans.n, rc) || ans.n.nlmsg_type == NLMSG_ERROR) {
+    close(sock);
+    return -1;
+  }
+  len = ans.n.nlmsg_len - NLMSG_LENGTH(GENL_HDRLEN);
+  for (na = (struct nlattr *)GENLMSG_DATA(&ans); len >= NLA_HDRLEN && na->nla_len >= NLA_HDRLEN; len -= NLA_ALIGN(na->nla_len), na = NLA_NEXT(na)) {
+    if (na->nla_type == CTRL_ATTR_FAMILY_ID) {
+      family = *(__u16 *)NLA_DATA(na);
+      break;
+    }
+  }
+  if (family == 0) {
+    close(sock);
+    return -1;
+  }
+
+  // Listen to the exit of the tasks on all cpus.
+  snprintf(mask, sizeof(mask), "0-%ld", sysconf(_SC_NPROCESSORS_CONF) - 1);
+  if (genl_send(sock, family, TASKSTATS_CMD_GET, TASKSTATS_CMD_ATTR_REGISTER_CPUMASK, mask, strlen(mask) + 1) == -1) {
+    close(sock);
+    return -1;
+  }
+  return sock;
+}
+
+/*
+ Read all the pending taskstats messages.
+ Only the per task ones are used, the per thread group aggregates only carry the delay accounting.
+ The memory and I/O counters are per thread (hiwater_rss is the one of the whole process).
+*/
+static void handle_ts(int ts_sock)
+{
+  char buf[8192];
+  int rc, len, nlen;
+  struct nlmsghdr *n;
+  struct nlattr *na, *nna;
+  struct taskstats *ts;
+  int tslen, tgid;
+
+  while ((rc = recv(ts_sock, buf, sizeof(buf), MSG_DONTWAIT)) > 0) {
+    for (n = (struct nlmsghdr *)buf; NLMSG_OK(n, rc); n = NLMSG_NEXT(n, rc)) {
+      if (n->nlmsg_type == NLMSG_ERROR || n->nlmsg_type == NLMSG_DONE) {
+        continue;
+      }
+      len = n->nlmsg_len - NLMSG_LENGTH(GENL_HDRLEN);
+      for (na = (struct nlattr *)GENLMSG_DATA(n); len >= NLA_HDRLEN && na->nla_len >= NLA_HDRLEN; len -= NLA_ALIGN(na->nla_len), na = NLA_NEXT(na)) {
+        if (na->nla_type != TASKSTATS_TYPE_AGGR_PID) {
+          continue;
+        }
+        // Nested attributes: the pid then the stats.
+        ts = NULL;
+        nlen = na->nla_len - NLA_HDRLEN;
+        for (nna = (struct nlattr *)NLA_DATA(na); nlen >= NLA_HDRLEN && nna->nla_len >= NLA_HDRLEN; nlen -= NLA_ALIGN(nna->nla_len), nna = NLA_NEXT(nna)) {
+          if (nna->nla_type == TASKSTATS_TYPE_STATS) {
+            ts = (struct taskstats *)NLA_DATA(nna);
+            tslen = nna->nla_len - NLA_HDRLEN;
+          }
+        }
+        if (ts != NULL) {
+          // ac_tgid only exists since the taskstats version 12, before that the threads are accounted separately.
+          tgid = tslen >= (int)(offsetof(struct taskstats, ac_tgid) + sizeof(ts->ac_tgid)) ? ts->ac_tgid : ts->ac_pid;
+          goTaskStats(tgid, ts->hiwater_rss, ts->ac_minflt, ts->ac_majflt, ts->read_bytes, ts->write_bytes, ts->ac_utime + ts->ac_stime);
+        }
+      }
+    }
+  }
+}
+
+static int handle_proc_ev(int nl_sock, int ts_sock)
 {
   int rc;
   struct __attribute__ ((aligned(NLMSG_ALIGNTO))) {
@@ -89,7 +235,23 @@ static int handle_proc_ev(int nl_sock)
     };
   } nlcn_msg;
 
+  struct pollfd fds[2] = {{nl_sock, POLLIN, 0}, {ts_sock, POLLIN, 0}};
+
   while (1) {
+    if (ts_sock != -1) {
+      // The taskstats of an exiting task are sent before its exit event, handle them first.
+      rc = poll(fds, 2, -1);
+      if (rc == -1 && errno != EINTR) {
+        perror("poll");
+        return -1;
+      }
+      if (fds[1].revents & POLLIN) {
+        handle_ts(ts_sock);
+      }
+      if (!(fds[0].revents & POLLIN)) {
+        continue;
+      }
+    }
     rc = recv(nl_sock, &nlcn_msg, sizeof(nlcn_msg), 0);
     if (rc == 0) {
       return 0;
@@ -126,7 +288,7 @@ static int handle_proc_ev(int nl_sock)
       break;
     case PROC_EVENT_EXIT:
       nbexitev++;
-	  goProcEventExit(nlcn_msg.proc_ev.event_data.exit.process_pid, ts);
+	  goProcEventExit(nlcn_msg.proc_ev.event_data.exit.process_pid, ts, nlcn_msg.proc_ev.event_data.exit.exit_code);
       /*printf("exit: tid=%d pid=%d exit_code=%d\n",
 	     nlcn_msg.proc_ev.event_data.exit.process_pid,
 	     nlcn_msg.proc_ev.event_data.exit.process_tgid,
@@ -149,21 +311,31 @@ static char* errMsg()
 	return strerror(errno);
 }
 
-static int getProcEvents(){
+/* taskstats: also listen to the taskstats of the exiting tasks. */
+static int getProcEvents(bool taskstats){
   int nl_sock;
+  int ts_sock = -1;
   int rc;
 
   nl_sock = nl_connect();
   if (nl_sock == -1)
     return -1;
+  if (taskstats) {
+    ts_sock = ts_connect();
+    if (ts_sock == -1)
+      fprintf(stderr, "taskstats not available, falling back on /proc/[pid] reads at exit.\n");
+  }
 
   rc = set_proc_ev_listen(nl_sock, true);
   if (rc == -1) {
     close(nl_sock);
     return -1;
   }
+  goProcEventsReady();
 
-  rc = handle_proc_ev(nl_sock);
+  rc = handle_proc_ev(nl_sock, ts_sock);
+  if (ts_sock != -1)
+    close(ts_sock);
   if (rc == -1) {
     close(nl_sock);
     return -1;
@@ -17,11 +17,14 @@ import (
 )
 
 const (
-	scCount = iota
-	scTime  = iota
+	scCount  = iota
+	scTime   = iota
+	scRSS    = iota // -m
+	scFaults = iota // -m
+	scIO     = iota // -m
 )
 
-var scStrings = [2]string{}
+var scStrings = [5]string{}
 
 var sortCriteria = scCount
 var vanishedCount uint64 // number of failed read in /proc/#/stat == vanished proces count.
@@ -37,21 +40,37 @@ var nbExecEv uint64 // count exec events.
 var nbExitEv uint64 // count exit events.
 
 type cmdInfo struct {
-	cmd   string // command
-	subec uint64 // count how many sub processes this command has owned (all descendents)
-	subet uint64 // cummulative execution time in sub processes.
-	spid  int    // pid that triggered the last tree climb.
-	ec    uint64 // number of times this command has been exec'ed().
-	et    uint64 // exec time in all instances of this command.
-	tsub  uint64 // cimmulative time in all sub processes of this command.
+	cmd   string              // command
+	subec uint64              // count how many sub processes this command has owned (all descendents)
+	subet uint64              // cummulative execution time in sub processes.
+	spid  int                 // pid that triggered the last tree climb.
+	ec    uint64              // number of times this command has been exec'ed().
+	et    uint64              // exec time in all instances of this command.
+	tsub  uint64              // cimmulative time in all sub processes of this command.
+	pc    uint64              // number of processes running this command when we started (see scanProc).
+	attrs *procAttrs          // attributes of the last instance, only when the report filters need them.
+	args  map[string]*argInfo // exec count per argument pattern (-a).
+	ctx   []*ctxInfo          // examples of execution contexts (-cwd, -env).
+	res   resUsage            // memory and I/O usage of all instances of this command (-m).
+	sres  resUsage            // memory and I/O usage of all sub processes of this command (-m).
+	eh    [32]uint64          // execution time histogram of this command (see ehist).
+	xh    *expHist            // execution time exponential histogram (-otlp).
 }
 
 type procInfo struct {
-	pid  int       // this process PID
-	ppid int       // parent PID
-	ppi  *procInfo // Parent process info.
-	ci   *cmdInfo  // Info about all processes sharing this command.
-	st   uint64    // start time.
+	pid  int         // this process PID
+	ppid int         // parent PID
+	ppi  *procInfo   // Parent process info.
+	ci   *cmdInfo    // Info about all processes sharing this command.
+	st   uint64      // start time.
+	pre  bool        // already running when we started (not spawned during this session).
+	skip bool        // dropped by the collection filters.
+	sess procSession // process group, session and controlling terminal.
+	ns   nsIds       // namespaces (-ns).
+	res  resUsage    // memory and I/O usage (-m).
+	cio  resUsage    // I/O of the exited children, included in its /proc/[pid]/io counters (-m).
+	ev   *execEvent  // exec event, if kept in the event stream (-events).
+	tn   *treeNode   // ancestry tree node (-A).
 }
 
 var mutInfos = sync.Mutex{} // protect the *info maps
@@ -66,17 +85,37 @@ func init() {
 	start = time.Now()
 	scStrings[scCount] = "number of exec"
 	scStrings[scTime] = "execution time"
+	scStrings[scRSS] = "peak RSS"
+	scStrings[scFaults] = "page faults"
+	scStrings[scIO] = "I/O bytes"
+}
+
+// Sort criteria of the lists without memory and I/O usage (count unless sorted by time).
+func execSortCriteria() int {
+	if sortCriteria == scTime {
+		return scTime
+	}
+	return scCount
 }
 
 // Reset all counters. (like a fresh start)
 func clearCounters() {
+	mutInfos.Lock()
+	defer mutInfos.Unlock()
 	procInfos = map[int](*procInfo){}
 	cmdInfos = map[string](*cmdInfo){}
 	ehist = [32]uint64{} // execution time histogram
 	nbforkev = 0
 	nbExecEv = 0
 	nbExitEv = 0
+	nbDroppedEv = 0
+	sessInfos = map[int](*sessInfo){}
+	nbTtyEv, nbTtyEt, nbNoTtyEt = 0, 0, 0
+	nsInfos = map[uint64](*nsInfo){}
+	procHist = expHist{}
+	clearTree()
 	start = time.Now()
+	scanProcLocked() // Keep the process tree seeded after the reset.
 }
 
 // Display the per process exec stats.
@@ -86,12 +125,17 @@ func statsExec(dts float64) {
 	var a UInt64Slice
 	mutInfos.Lock()
 	for _, ci := range cmdInfos {
+		if !reportAccept(ci) {
+			continue
+		}
 		var ui uint64
 		switch sortCriteria {
 		case scCount:
 			ui = ci.ec
 		case scTime:
 			ui = ci.et
+		default:
+			ui = ci.res.key(sortCriteria)
 		}
 		if ui != 0 {
 			n[ui] = append(n[ui], ci)
@@ -135,6 +179,9 @@ func statsExec(dts float64) {
 					fmt.Fprintf(out, "%s: %.2f%% (%d) %.2fe/s\n", cmd, ecpc, ec, eps)
 				}
 			}
+			if memOn {
+				statsRes(cmd, &ci.res, false)
+			}
 			i++
 			if i > top {
 				return
@@ -150,8 +197,7 @@ func statsSub(dts float64) {
 	var a UInt64Slice
 	mutInfos.Lock()
 	for _, ci := range cmdInfos {
-		if ci.subec == 0 || ci.cmd == "" || ci.cmd == "init" || ci.cmd == "systemd" {
-			// No sub processes or we know that every process is sub of init, no need to mess stats with this one.
+		if ci.subec == 0 || ci.cmd == "" || !subReportAccept(ci) {
 			continue
 		}
 		var ui uint64
@@ -160,6 +206,8 @@ func statsSub(dts float64) {
 			ui = ci.subec
 		case scTime:
 			ui = ci.subet
+		default:
+			ui = ci.sres.key(sortCriteria)
 		}
 		if ui != 0 {
 			n[ui] = append(n[ui], ci)
@@ -178,9 +226,16 @@ func statsSub(dts float64) {
 				cmd = "(vanished)"
 			}
 			if raw {
-				fmt.Fprintf(out, "cp:%s:%.2f%:%d:%.2f\n", cmd, (float32(ci.subec*100) / float32(nbExecEv)), ci.subec, (float64(ci.subec) / dts))
+				fmt.Fprintf(out, "cp:%s:%.2f:%d:%.2f\n", cmd, (float32(ci.subec*100) / float32(nbExecEv)), ci.subec, (float64(ci.subec) / dts))
 			} else {
-				fmt.Fprintf(out, "%s: %.2f%% (%d) %.2fe/s\n", cmd, (float32(ci.subec*100) / float32(nbExecEv)), ci.subec, (float64(ci.subec) / dts))
+				pre := ""
+				if ci.ec == 0 && ci.pc != 0 {
+					pre = " [pre-existing]" // Only instances started before this session.
+				}
+				fmt.Fprintf(out, "%s: %.2f%% (%d) %.2fe/s%s\n", cmd, (float32(ci.subec*100) / float32(nbExecEv)), ci.subec, (float64(ci.subec) / dts), pre)
+			}
+			if memOn {
+				statsRes(cmd, &ci.sres, true)
 			}
 			i++
 			if i > top {
@@ -231,10 +286,86 @@ func statsEHist(dts float64) {
 		}
 	}
 	fmt.Fprintf(out, "\n")
+	statsEHistTop(firsti, lasti)
+}
+
+// Display the commands that dominate every bucket of the execution time histogram.
+func statsEHistTop(firsti, lasti int) {
+	type bucketCmd struct {
+		cmd string
+		n   uint64
+	}
+	var bcs [len(ehist)][]bucketCmd
+	mutInfos.Lock()
+	for _, ci := range cmdInfos {
+		if !reportAccept(ci) {
+			continue
+		}
+		cmd := ci.cmd
+		if cmd == "" {
+			cmd = "(vanished)"
+		}
+		for l := firsti; l <= lasti; l++ {
+			if ci.eh[l] != 0 {
+				bcs[l] = append(bcs[l], bucketCmd{cmd, ci.eh[l]})
+			}
+		}
+	}
+	mutInfos.Unlock()
+	p := 1
+	for l := 0; l < firsti; l++ {
+		p *= 10
+	}
+	for l := firsti; l <= lasti; l++ {
+		p *= 10
+		if len(bcs[l]) == 0 {
+			continue
+		}
+		bc := bcs[l]
+		sort.Slice(bc, func(i, j int) bool {
+			if bc[i].n != bc[j].n {
+				return bc[i].n > bc[j].n
+			}
+			return bc[i].cmd < bc[j].cmd
+		})
+		if len(bc) > 3 {
+			bc = bc[:3]
+		}
+		if raw {
+			for _, c := range bc {
+				fmt.Fprintf(out, "hb:%s:%s:%.2f:%d\n", time.Duration(p), c.cmd, float32(c.n*100)/float32(ehist[l]), c.n)
+			}
+			continue
+		}
+		fmt.Fprintf(out, "<%-6s", time.Duration(p))
+		for _, c := range bc {
+			fmt.Fprintf(out, " %s %.2f%% (%d)", c.cmd, float32(c.n*100)/float32(ehist[l]), c.n)
+		}
+		fmt.Fprintf(out, "\n")
+	}
 }
 
 // Display a summary of gathered statitistics about evec() events.
 func stats() {
+	out.beginStats()
+	defer out.endStats()
+	switch outFormat {
+	case "json":
+		statsJSON()
+		return
+	case "influx":
+		statsInflux()
+		return
+	case "html":
+		statsHTML()
+		return
+	case "csv":
+		statsCSV()
+		return
+	case "pprof":
+		statsPprof()
+		return
+	}
 	dt := time.Since(start)
 	dts := dt.Seconds()
 	getTermDimensions() // Update the term width every display.
@@ -244,50 +375,55 @@ func stats() {
 	fmt.Fprintf(out, "date:               %s\n", time.Now())
 	fmt.Fprintf(out, "time since start:   %s\n", time.Duration.String(dt))
 	fmt.Fprintf(out, "total exec calls:   %d (%.2fe/s)\n", nbExecEv, float32(nbExecEv)/float32(dts))
-	fmt.Fprintf(out, "forks w/o exec:     %d (%.2ff/s)\n", nbforkev-nbExecEv, float32(nbforkev-nbExecEv)/float32(dts))
+	nbfwoe := nbforkev - nbExecEv - nbDroppedEv
+	fmt.Fprintf(out, "forks w/o exec:     %d (%.2ff/s)\n", nbfwoe, float32(nbfwoe)/float32(dts))
+	if nbDroppedEv != 0 {
+		fmt.Fprintf(out, "filtered out exec:  %d (%.2fe/s)\n", nbDroppedEv, float32(nbDroppedEv)/float32(dts))
+	}
+	if len(attachPids) != 0 {
+		fmt.Fprintf(out, "attached to pids:   %s\n", attachPids.String())
+	}
+	fmt.Fprintf(out, "pre-existing procs: %d\n", nbPreProcs)
 	fmt.Fprintf(out, "number of comamnds: %d\n", len(cmdInfos))
 	fmt.Fprintf(out, "removed/vanished:   %d/%d\n", removedCount, vanishedCount)
 	statsExec(dts)
 	if !raw {
 		statsEHist(dts)
+	} else {
+		statsEHistTop(0, len(ehist)-1)
 	}
 	statsSub(dts)
+	if argsOn {
+		statsArgs()
+	}
+	if cwdOn || len(envKeys) != 0 {
+		statsContext()
+	}
+	if sessionsOn {
+		statsSessions(dts)
+	}
+	if nsOn {
+		statsNs(dts)
+	}
+	if treeOn {
+		statsTree(dts)
+	}
 	printSep(out, "")
 }
 
 // Extract the command (and ppid) from /proc/[pid]/stat
 func getProcessStat(pid int) (string, int) {
-	fn := fmt.Sprintf("/proc/%d/stat", pid)
-	s, err := fastRead(fn)
-	sl := len(s)
-	if err != nil || sl == 0 {
+	cmd, ppid, _ := getProcessStatSession(pid)
+	return cmd, ppid
+}
+
+// Extract the command, ppid and session fields from /proc/[pid]/stat
+func getProcessStatSession(pid int) (string, int, procSession) {
+	cmd, ppid, ps, _ := getProcessStartStat(pid)
+	if ppid < 0 {
 		vanishedCount++
-		return "", -1
-	}
-	var f int // field number (0 is pid)
-	var i64 int64
-	var cmd string
-	for i := 0; i < sl; i++ {
-		//fmt.Fprintf(out,"f:%d i:%d c:%c\n", f, i, s[i])
-		switch f {
-		case 1: // 1 tcomm
-			i++ // Skip the '('.
-			cmd, i = fastParseUntil(s, i, ')')
-		case 3: // 3 ppid
-			i64, i = fastParseInt(s, i)
-			return cmd, int(i64)
-		default: // Skip this field.
-			i++
-			for ; i < sl; i++ {
-				if s[i] == ' ' {
-					break
-				}
-			}
-		}
-		// Assume one and only one ' '  between fields.
-		f++
 	}
-	return "", -1
+	return cmd, ppid, ps
 }
 
 //export goProcEventFork
@@ -317,7 +453,7 @@ func cleanProcInfos() {
 // Assumes the global maps are locked.
 func makeProcInfo(pid int, vanished bool) *procInfo {
 	// Get infos for this unknown PID.
-	cmd, ppid := getProcessStat(pid)
+	cmd, ppid, ps := getProcessStatSession(pid)
 	if cmd == "" { // Missed the /proc/pid file, we have no pertinent data to store, skip the map entry.
 		if vanished == false {
 			return nil
@@ -326,14 +462,17 @@ func makeProcInfo(pid int, vanished bool) *procInfo {
 	// Create the structs even if process vanished.
 	var ci *cmdInfo
 	var known bool
-	if ci, known = cmdInfos[cmd]; known {
-		ci.ec++
-	} else { // new command
-		ci = &cmdInfo{cmd: cmd, ec: 1}
+	if ci, known = cmdInfos[cmd]; !known { // new command
+		ci = &cmdInfo{cmd: cmd}
 		cmdInfos[cmd] = ci
 	}
+	// Only the exec() events go through the collection filters.
+	skip := vanished && !collectAccept(pid, ppid, cmd, ci)
+	if !skip {
+		ci.ec++
+	}
 	// New global procInfos map entry.
-	pi := &procInfo{pid: pid, ppid: ppid, ci: ci}
+	pi := &procInfo{pid: pid, ppid: ppid, ci: ci, skip: skip, sess: ps}
 	procInfos[pid] = pi
 	return pi
 }
@@ -342,21 +481,42 @@ func makeProcInfo(pid int, vanished bool) *procInfo {
 func goProcEventExec(cpid C.int, cts, nf, ne C.ulong) {
 	pid := int(cpid)
 	nbforkev = uint64(nf)
-	nbExecEv++ // this event
 	nbExitEv = uint64(ne)
 	mutInfos.Lock()
 	pi := makeProcInfo(pid, true)
 	pi.st = uint64(cts) // event stamp is process start time.
+	if pi.skip {
+		nbDroppedEv++
+		mutInfos.Unlock()
+		return
+	}
+	nbExecEv++ // this event
+	if sessionsOn {
+		recordSession(pi)
+	}
+	if nsOn && pi.ci.cmd != "" {
+		recordNs(pi)
+	}
+	if argsOn && pi.ci.cmd != "" {
+		recordArgs(pid, pi.ci)
+	}
+	if (cwdOn || len(envKeys) != 0) && pi.ci.cmd != "" {
+		recordContext(pid, pi.ci)
+	}
+	if events != nil {
+		eventExec(pi)
+	}
 	// defer Unlock() is slower than explicit call but need to be cautious with stray returns.
 
 	// Climb process tree up to its root (init)
 	// For every ancestor of pid we increment its count of subprocesses.
 	spid := pid // initial PID from where we start
+	epi := pi
+	var anc []string // ancestor commands (-A).
 	for {
 		if pid <= 1 {
 			// We are at the process tree root (init)
-			mutInfos.Unlock()
-			return
+			break
 		}
 		// Climb one parent process up.
 		var ppi *procInfo
@@ -369,14 +529,23 @@ func goProcEventExec(cpid C.int, cts, nf, ne C.ulong) {
 				ppi = makeProcInfo(pi.ppid, false)
 				if ppi == nil {
 					// No more info about parent process. Stop climbing.
-					mutInfos.Unlock()
-					return
+					break
 				}
 			}
 			pi.ppi = ppi
 		}
+		if rootPids[ppi.pid] && ppi.pid == selfPid {
+			break // Run mode, we are the root but not part of the accounted tree.
+		}
 
 		ci := ppi.ci
+		if treeOn {
+			cmd := ci.cmd
+			if cmd == "" {
+				cmd = "(vanished)"
+			}
+			anc = append(anc, cmd)
+		}
 		if ci.spid != spid {
 			// This command sub processes count has not already been incremented for the current spid (original process pid in the exec() event)
 			// The thing we want to avoid in the below example is incrementing twice the bash count of subprocesses during the grep exec() event.
@@ -385,14 +554,20 @@ func goProcEventExec(cpid C.int, cts, nf, ne C.ulong) {
 			ci.subec++
 			ci.spid = spid
 		}
+		if rootPids[ppi.pid] {
+			break // Only the subtrees of the root pids are accounted.
+		}
 		pi = ppi
 		pid = pi.pid
 	}
+	if treeOn {
+		recordTree(epi, anc)
+	}
 	mutInfos.Unlock()
 }
 
 //export goProcEventExit
-func goProcEventExit(cpid C.int, cts C.ulong) {
+func goProcEventExit(cpid C.int, cts C.ulong, ccode C.int) {
 	//fmt.Fprintf(out, "Exit: pid=%d\n", pid)
 	pid := int(cpid)
 	dt := uint64(cts) // death time stamp.
@@ -400,19 +575,57 @@ func goProcEventExit(cpid C.int, cts C.ulong) {
 	if pi, known := procInfos[pid]; known {
 		delete(procInfos, pid)
 		ci := pi.ci
-		if pi.st != 0 {
+		if pi.st != 0 && !pi.skip {
 			et := dt - pi.st // death - start == execution time
 			ci.et += et
 			i := int(math.Log10(float64(et)))
 			//fmt.Printf("%d %d (%d/%d)\n", i, et, len(ehist))
 			ehist[i]++
-			// Add this execution time to all parent process command infos.
-			spid := pid
+			ci.eh[i]++
+			if otlp != nil {
+				if ci.xh == nil {
+					ci.xh = &expHist{}
+				}
+				ci.xh.record(float64(et) / 1e9)
+				procHist.record(float64(et) / 1e9)
+			}
+			if sessionsOn {
+				sessionExit(pi, et)
+			}
+			if nsOn {
+				nsExit(pi, et)
+			}
+			if pi.ev != nil && events != nil {
+				eventExit(pi, et, int(ccode))
+			}
+			if memOn {
+				if pi.res.n == 0 {
+					readExitUsage(pi) // No taskstats for it.
+				}
+				ci.res.add(&pi.res)
+			}
+			if pi.tn != nil {
+				pi.tn.et += et
+				pi.tn.cpu += pi.res.cpu
+			}
+			// Add this execution time (and usage) to all parent process command infos.
+			res := pi.res
+			// The marker is negated: the exec() climb of this same pid already set the positive one.
+			spid := -pid
 			for ; pi != nil; pi = pi.ppi {
+				if rootPids[pi.pid] && pi.pid == selfPid {
+					break
+				}
 				if pi.ci.spid != spid {
 					pi.ci.subet += et
+					if memOn {
+						pi.ci.sres.add(&res)
+					}
 					pi.ci.spid = spid
 				}
+				if rootPids[pi.pid] {
+					break
+				}
 			}
 		}
 	}
@@ -420,6 +633,11 @@ func goProcEventExit(cpid C.int, cts C.ulong) {
 	removedCount++
 }
 
+//export goProcEventsReady
+func goProcEventsReady() {
+	ready()
+}
+
 // Get process events directly from the Linux kernel (via tne netlink. No lag, no missed events, ... Far superior to any scan based algorithm but not portable.
 func getProcEvents() {
 	// Set a high scheduling priority to give this process to better chances to access /proc/[pid]/stat fast enough once it gets a netlink exec() event.
@@ -427,8 +645,8 @@ func getProcEvents() {
 
 	// This C function will connect to the kernel and wait for all events.
 	// Events will be handled by callbacks in go. (see goProcEvent* functions above(.
-	cr := C.getProcEvents() // This call will not return unless an error occurs (loop on select)
+	cr := C.getProcEvents(C.bool(memOn)) // This call will not return unless an error occurs (loop on select)
 	if cr == -1 {
-		fmt.Fprintf(os.Stderr, "Unable to set the Netlink socket properly.\nRemember that you need root privileges to do that.\n")
+		logf(prioErr, "Unable to set the Netlink socket properly.\nRemember that you need root privileges (or CAP_NET_ADMIN) to do that.")
 	}
 }
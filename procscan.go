@@ -0,0 +1,138 @@
+package main
+
+/*
+#include <time.h>
+#include <unistd.h>
+
+// Offset between CLOCK_BOOTTIME (used for /proc/[pid]/stat start times) and CLOCK_MONOTONIC (used for netlink event stamps).
+static long long bootOffset() {
+  struct timespec b, m;
+  clock_gettime(CLOCK_BOOTTIME, &b);
+  clock_gettime(CLOCK_MONOTONIC, &m);
+  return (b.tv_sec - m.tv_sec) * 1000000000LL + (b.tv_nsec - m.tv_nsec);
+}
+
+// CLOCK_MONOTONIC now (ns).
+static long long monotonicNow() {
+  struct timespec m;
+  clock_gettime(CLOCK_MONOTONIC, &m);
+  return m.tv_sec * 1000000000LL + m.tv_nsec;
+}
+
+static long clockTicks() {
+  return sysconf(_SC_CLK_TCK);
+}
+*/
+import "C"
+
+import (
+	"os"
+	"strconv"
+)
+
+var nbPreProcs uint64 // number of processes found by the /proc scan (already running when we started).
+
+var userHZ = int64(C.clockTicks()) // clock ticks per second of the /proc times (USER_HZ).
+
+// Extract the command, ppid, session fields and start time (in clock ticks since boot) from /proc/[pid]/stat
+func getProcessStartStat(pid int) (string, int, procSession, int64) {
+	var ps procSession
+	s, err := fastRead("/proc/" + strconv.Itoa(pid) + "/stat")
+	sl := len(s)
+	if err != nil || sl == 0 {
+		return "", -1, ps, 0
+	}
+	var f int // field number (0 is pid)
+	var i64 int64
+	var cmd string
+	ppid := -1
+	for i := 0; i < sl; i++ {
+		switch f {
+		case 1: // 1 tcomm
+			i++ // Skip the '('.
+			// The command may contain ')', the field ends at the last one.
+			j := sl - 1
+			for ; j > i && s[j] != ')'; j-- {
+			}
+			cmd, i = string(s[i:j]), j
+		case 3: // 3 ppid
+			i64, i = fastParseInt(s, i)
+			ppid = int(i64)
+		case 4: // 4 pgrp
+			i64, i = fastParseInt(s, i)
+			ps.pgrp = int(i64)
+		case 5: // 5 sid
+			i64, i = fastParseInt(s, i)
+			ps.sid = int(i64)
+		case 6: // 6 tty_nr
+			i64, i = fastParseInt(s, i)
+			ps.tty = int(i64)
+		case 21: // 21 starttime
+			i64, i = fastParseInt(s, i)
+			return cmd, ppid, ps, i64
+		default: // Skip this field.
+			i++
+			for ; i < sl; i++ {
+				if s[i] == ' ' {
+					break
+				}
+			}
+		}
+		f++
+	}
+	return "", -1, ps, 0
+}
+
+// Seed the procInfos map with all the processes already running.
+// Without it, ancestors are only discovered lazily when one of their descendants exec()s and only if they are still alive.
+func scanProc() {
+	mutInfos.Lock()
+	scanProcLocked()
+	mutInfos.Unlock()
+}
+
+// scanProc with the global maps locked.
+func scanProcLocked() {
+	d, err := os.Open("/proc")
+	if err != nil {
+		return
+	}
+	names, _ := d.Readdirnames(-1)
+	d.Close()
+	off := int64(C.bootOffset())
+	now := int64(C.monotonicNow())
+	var pis []*procInfo
+	for _, n := range names {
+		pid, err := strconv.Atoi(n)
+		if err != nil {
+			continue // Not a process directory.
+		}
+		cmd, ppid, ps, stt := getProcessStartStat(pid)
+		if cmd == "" {
+			continue // Vanished since the directory read.
+		}
+		ci, known := cmdInfos[cmd]
+		if !known {
+			ci = &cmdInfo{cmd: cmd}
+			cmdInfos[cmd] = ci
+		}
+		ci.pc++
+		// Convert the start time to the netlink events time base.
+		// Only the time spent during this session is accounted: the earlier starts are clamped to now.
+		st := stt*(1000000000/userHZ) - off
+		if st < now {
+			st = now
+		}
+		pi := &procInfo{pid: pid, ppid: ppid, ci: ci, st: uint64(st), pre: true, sess: ps}
+		procInfos[pid] = pi
+		pis = append(pis, pi)
+	}
+	for _, pi := range pis {
+		pi.ppi = procInfos[pi.ppid]
+	}
+	// Their exit is only accounted if they pass the collection filters (and -p).
+	for _, pi := range pis {
+		pi.skip = !collectAccept(pi.pid, pi.ppid, pi.ci.cmd, pi.ci)
+	}
+	nbPreProcs = uint64(len(pis))
+}
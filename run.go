@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var selfPid = os.Getpid()
+
+// Only the exec() events of the descendants of these pids are accounted (-p or run mode).
+var rootPids = map[int]bool{}
+
+var attachPids pidList // -p
+
+// A list of pids, usable as a repeatable flag.
+type pidList []int
+
+func (l *pidList) String() string {
+	if l == nil {
+		return ""
+	}
+	var ps []string
+	for _, p := range *l {
+		ps = append(ps, strconv.Itoa(p))
+	}
+	return strings.Join(ps, ",")
+}
+
+// Set adds comma separated pids to the list.
+func (l *pidList) Set(v string) error {
+	for _, p := range strings.Split(v, ",") {
+		pid, err := strconv.Atoi(p)
+		if err != nil || pid <= 0 {
+			return fmt.Errorf("invalid pid '%s'", p)
+		}
+		*l = append(*l, pid)
+	}
+	return nil
+}
+
+func (l *pidList) reset() {
+	*l = nil
+}
+
+// Rebuild the root pids from the options, they are left unchanged on error.
+// An attached pid that exited since is kept (with a warning), an empty set would account every process.
+// Assumes the global maps are locked.
+func setRootPids() error {
+	rp := map[int]bool{}
+	if runArgs != nil {
+		rp[selfPid] = true
+	}
+	for _, pid := range attachPids {
+		if _, err := os.Stat("/proc/" + strconv.Itoa(pid)); err != nil {
+			if !rootPids[pid] {
+				return fmt.Errorf("no process with pid %d", pid)
+			}
+			logf(prioWarning, "Attached pid %d has exited.", pid)
+		}
+		rp[pid] = true
+	}
+	rootPids = rp
+	return nil
+}
+
+var runArgs []string // command to run and trace (run mode).
+var runCmd *exec.Cmd // the running command.
+
+// Check if a process is a root pid or one of their descendants.
+// Assumes the global maps are locked.
+func underRoots(pid, ppid int) bool {
+	for n := 0; n < 1024; n++ { // Guards against loops (pid reuse).
+		if rootPids[pid] {
+			return true
+		}
+		if ppid <= 0 {
+			return false
+		}
+		pid = ppid
+		if pi, known := procInfos[pid]; known {
+			ppid = pi.ppid
+		} else {
+			// Forked without exec(), not in the map.
+			_, ppid = getProcessStat(pid)
+		}
+	}
+	return false
+}
+
+// Setup the run mode: we are the root of the accounted processes.
+func startRun(args []string) {
+	runArgs = args
+	rootPids[selfPid] = true
+}
+
+// Run the command (once we listen to the process events), display the stats when it exits and exit with its status.
+func runAndTrace() {
+	runCmd = exec.Command(runArgs[0], runArgs[1:]...)
+	runCmd.Stdin = os.Stdin
+	runCmd.Stdout = os.Stdout
+	runCmd.Stderr = os.Stderr
+	if err := runCmd.Start(); err != nil {
+		logf(prioErr, "%s", err)
+		shutdown(127)
+	}
+	err := runCmd.Wait()
+	code := 0
+	if err != nil {
+		code = 1
+		if ee, ok := err.(*exec.ExitError); ok {
+			if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+				code = ws.ExitStatus()
+				if ws.Signaled() {
+					code = 128 + int(ws.Signal())
+				}
+			}
+		} else {
+			logf(prioErr, "%s", err)
+		}
+	}
+	// Give the last exit events some time to reach us.
+	time.Sleep(100 * time.Millisecond)
+	stats()
+	if outFormat == "text" {
+		fmt.Fprintf(out, "%s exited with status %d.\n", runArgs[0], code)
+	}
+	shutdown(code)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var sessionsOn bool // -S: display the stats per login session.
+
+const sessMax = 1000 // beyond this number of sessions, the new ones are accounted together.
+
+// Fields of /proc/[pid]/stat beyond the ppid.
+type procSession struct {
+	pgrp int // process group id.
+	sid  int // session id.
+	tty  int // controlling terminal device number (0: none).
+}
+
+// Stats of a session.
+type sessInfo struct {
+	sid    int
+	tty    int
+	leader string // command of the session leader.
+	user   string // owner of the session leader.
+	ec     uint64 // number of exec() in this session.
+	et     uint64 // exec time of the processes of this session.
+}
+
+// For every session id stores its informations.
+var sessInfos = map[int](*sessInfo){}
+
+var nbTtyEv uint64   // exec events with a controlling terminal (interactive).
+var nbTtyEt uint64   // exec time of the processes with a controlling terminal.
+var nbNoTtyEt uint64 // exec time of the processes without a controlling terminal.
+
+// Name of a terminal from its device number (see tty_nr in proc(5)).
+func ttyName(tty int) string {
+	if tty == 0 {
+		return "-"
+	}
+	maj := (tty >> 8) & 0xfff
+	min := (tty & 0xff) | ((tty >> 12) & 0xfff00)
+	switch {
+	case maj >= 136 && maj <= 143:
+		return "pts/" + strconv.Itoa(min+(maj-136)*256)
+	case maj == 4 && min < 64:
+		return "tty" + strconv.Itoa(min)
+	case maj == 4:
+		return "ttyS" + strconv.Itoa(min-64)
+	}
+	return fmt.Sprintf("tty(%d:%d)", maj, min)
+}
+
+// Get (or create) the info of the session of a process.
+// Assumes the global maps are locked.
+func getSessInfo(ps procSession) *sessInfo {
+	si, known := sessInfos[ps.sid]
+	if known {
+		return si
+	}
+	if len(sessInfos) >= sessMax {
+		if si, known = sessInfos[-1]; !known {
+			si = &sessInfo{sid: -1, leader: "(other sessions)"}
+			sessInfos[-1] = si
+		}
+		return si
+	}
+	si = &sessInfo{sid: ps.sid, tty: ps.tty}
+	if pi, known := procInfos[ps.sid]; known {
+		si.leader = pi.ci.cmd
+	} else {
+		si.leader, _ = getProcessStat(ps.sid)
+	}
+	if si.leader == "" {
+		si.leader = "(vanished)"
+	}
+	if fi, err := os.Stat("/proc/" + strconv.Itoa(ps.sid)); err == nil {
+		uid := strconv.Itoa(int(fi.Sys().(*syscall.Stat_t).Uid))
+		si.user = uid
+		if u, err := user.LookupId(uid); err == nil {
+			si.user = u.Username
+		}
+	}
+	sessInfos[ps.sid] = si
+	return si
+}
+
+// Account an exec() event to its session.
+// Assumes the global maps are locked.
+func recordSession(pi *procInfo) {
+	if pi.sess.sid <= 0 {
+		return // Vanished.
+	}
+	getSessInfo(pi.sess).ec++
+	if pi.sess.tty != 0 {
+		nbTtyEv++
+	}
+}
+
+// Account the execution time of an exited process to its session.
+// Assumes the global maps are locked.
+func sessionExit(pi *procInfo, et uint64) {
+	if pi.sess.sid <= 0 {
+		return
+	}
+	getSessInfo(pi.sess).et += et
+	if pi.sess.tty != 0 {
+		nbTtyEt += et
+	} else {
+		nbNoTtyEt += et
+	}
+}
+
+// Display the exec stats per session.
+func statsSessions(dts float64) {
+	printSep(out, " top %d sessions sorted by %s ", top, scStrings[execSortCriteria()])
+	var sis []*sessInfo
+	var set uint64
+	mutInfos.Lock()
+	for _, si := range sessInfos {
+		set += si.et
+		if si.ec != 0 || si.et != 0 {
+			c := *si
+			sis = append(sis, &c)
+		}
+	}
+	mutInfos.Unlock()
+	key := func(si *sessInfo) uint64 {
+		if execSortCriteria() == scTime {
+			return si.et
+		}
+		return si.ec
+	}
+	sort.Slice(sis, func(i, j int) bool { return key(sis[i]) > key(sis[j]) })
+	var ni uint64
+	if nbExecEv >= nbTtyEv {
+		ni = nbExecEv - nbTtyEv
+	}
+	if raw {
+		fmt.Fprintf(out, "it:%d:%d:%d:%d\n", nbTtyEv, nbTtyEt, ni, nbNoTtyEt)
+	} else {
+		fmt.Fprintf(out, "interactive:        %.2f%% (%d) %s\n", float32(nbTtyEv*100)/float32(max64(int64(nbExecEv), 1)), nbTtyEv, time.Duration(nbTtyEt))
+		fmt.Fprintf(out, "non-interactive:    %.2f%% (%d) %s\n", float32(ni*100)/float32(max64(int64(nbExecEv), 1)), ni, time.Duration(nbNoTtyEt))
+	}
+	for i, si := range sis {
+		if i >= top {
+			break
+		}
+		ecpc := float32(si.ec*100) / float32(max64(int64(nbExecEv), 1))
+		etpc := float32(si.et*100) / float32(max64(int64(set), 1))
+		if raw {
+			fmt.Fprintf(out, "ss:%d:%s:%s:%s:%.2f:%d:%.2f:%s:%.2f\n", si.sid, ttyName(si.tty), si.leader, si.user, ecpc, si.ec, float64(si.ec)/dts, time.Duration(si.et), etpc)
+		} else {
+			fmt.Fprintf(out, "%d %s %s (%s): %.2f%% (%d) %.2fe/s %s (%.2f%%)\n", si.sid, ttyName(si.tty), si.leader, si.user, ecpc, si.ec, float64(si.ec)/dts, time.Duration(si.et), etpc)
+		}
+	}
+}
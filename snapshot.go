@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var outFormat string // stats output format (text, json, influx, html, csv or pprof).
+
+// A snapshot of the gathered statistics (json output format).
+type snapshot struct {
+	Hostname string         `json:"hostname"`
+	Date     time.Time      `json:"date"`
+	Start    time.Time      `json:"start"`
+	Duration int64          `json:"duration_ns"`
+	Exec     uint64         `json:"exec"`
+	Forks    uint64         `json:"forks_without_exec"`
+	Exit     uint64         `json:"exit"`
+	Dropped  uint64         `json:"filtered_out"`
+	Pre      uint64         `json:"pre_existing"`
+	Removed  uint64         `json:"removed"`
+	Vanished uint64         `json:"vanished"`
+	Hist     []uint64       `json:"histogram"` // bucket i counts the processes that lived less than 10^(i+1) ns (and more than 10^i ns).
+	Cmds     []cmdSnapshot  `json:"commands"`
+	Sessions []sessSnapshot `json:"sessions,omitempty"`       // -S
+	Ns       []nsSnapshot   `json:"pid_namespaces,omitempty"` // -ns
+	Tree     *treeSnapshot  `json:"tree,omitempty"`           // -A
+}
+
+// Statistics of a pid namespace in a snapshot (-ns).
+type nsSnapshot struct {
+	Ino     uint64            `json:"inode"`
+	Host    bool              `json:"host"`
+	MntNs   uint64            `json:"mnt_inode"`
+	Init    string            `json:"init"`
+	InitPid int               `json:"init_host_pid,omitempty"`
+	InitNs  int               `json:"init_nspid"` // 1, else the process named as init until it is seen.
+	Exec    uint64            `json:"exec"`
+	Time    uint64            `json:"time_ns"`
+	Cmds    map[string]uint64 `json:"commands"`
+}
+
+// Statistics of a session in a snapshot (-S).
+type sessSnapshot struct {
+	Sid    int    `json:"sid"`
+	Tty    string `json:"tty"`
+	Leader string `json:"leader"`
+	User   string `json:"user"`
+	Exec   uint64 `json:"exec"`
+	Time   uint64 `json:"time_ns"`
+}
+
+// Statistics of a command in a snapshot.
+type cmdSnapshot struct {
+	Cmd     string         `json:"cmd"`
+	Exec    uint64         `json:"exec"`
+	Time    uint64         `json:"time_ns"`
+	SubExec uint64         `json:"sub_exec"`
+	SubTime uint64         `json:"sub_time_ns"`
+	SubHide bool           `json:"sub_hidden,omitempty"` // -hide-sub: not in the subtrees lists.
+	Pre     uint64         `json:"pre_existing,omitempty"`
+	Hist    []uint64       `json:"histogram,omitempty"` // same buckets as the global histogram.
+	Args    []argsSnapshot `json:"args,omitempty"`
+	Ctx     []ctxSnapshot  `json:"context,omitempty"`
+	Res     *resSnapshot   `json:"usage,omitempty"`     // -m
+	SubRes  *resSnapshot   `json:"sub_usage,omitempty"` // -m
+}
+
+// Memory and I/O usage in a snapshot (-m).
+type resSnapshot struct {
+	Procs    uint64 `json:"procs"`
+	RSSProcs uint64 `json:"rss_procs"`
+	MaxRSS   uint64 `json:"max_rss_kb"`
+	RSS      uint64 `json:"sum_rss_kb"`
+	MinFlt   uint64 `json:"minflt"`
+	MajFlt   uint64 `json:"majflt"`
+	Read     uint64 `json:"read_bytes"`
+	Write    uint64 `json:"write_bytes"`
+	CPU      uint64 `json:"cpu_ns"`
+}
+
+// Snapshot of a memory and I/O usage (nil if nothing was sampled).
+func makeResSnapshot(r *resUsage) *resSnapshot {
+	if r.n == 0 {
+		return nil
+	}
+	return &resSnapshot{Procs: r.n, RSSProcs: r.nrss, MaxRSS: r.maxrss, RSS: r.rss, MinFlt: r.minflt, MajFlt: r.majflt, Read: r.rb, Write: r.wb, CPU: r.cpu}
+}
+
+// Exec count of an argument pattern in a snapshot (-a).
+type argsSnapshot struct {
+	Pattern string   `json:"pattern"`
+	Exec    uint64   `json:"exec"`
+	Samples []string `json:"samples"`
+}
+
+// Execution context example in a snapshot (-cwd, -env).
+type ctxSnapshot struct {
+	Cwd  string            `json:"cwd,omitempty"`
+	Env  map[string]string `json:"env,omitempty"`
+	Exec uint64            `json:"exec"`
+}
+
+// Build a snapshot of the current statistics (only the commands accepted by the report filters).
+func takeSnapshot() *snapshot {
+	hn, _ := os.Hostname()
+	now := time.Now()
+	s := &snapshot{
+		Hostname: hn,
+		Date:     now,
+		Start:    start,
+		Duration: int64(now.Sub(start)),
+		Exec:     nbExecEv,
+		Forks:    nbforkev - nbExecEv - nbDroppedEv,
+		Exit:     nbExitEv,
+		Dropped:  nbDroppedEv,
+		Pre:      nbPreProcs,
+		Removed:  removedCount,
+		Vanished: vanishedCount,
+		Cmds:     []cmdSnapshot{},
+	}
+	mutInfos.Lock()
+	last := 0
+	for l := range ehist {
+		if ehist[l] != 0 {
+			last = l + 1
+		}
+	}
+	s.Hist = append([]uint64{}, ehist[:last]...)
+	for _, ci := range cmdInfos {
+		if ci.ec == 0 && ci.et == 0 && ci.subec == 0 && ci.subet == 0 {
+			continue
+		}
+		if !reportAccept(ci) {
+			continue
+		}
+		cmd := ci.cmd
+		if cmd == "" {
+			cmd = "(vanished)"
+		}
+		cs := cmdSnapshot{Cmd: cmd, Exec: ci.ec, Time: ci.et, SubExec: ci.subec, SubTime: ci.subet, SubHide: !subReportAccept(ci), Pre: ci.pc, Res: makeResSnapshot(&ci.res), SubRes: makeResSnapshot(&ci.sres)}
+		for l := range ci.eh {
+			if ci.eh[l] != 0 {
+				cs.Hist = append([]uint64{}, ci.eh[:l+1]...)
+			}
+		}
+		for _, ai := range sortedArgs(ci) {
+			cs.Args = append(cs.Args, argsSnapshot{Pattern: ai.pattern, Exec: ai.ec, Samples: ai.samples})
+		}
+		for _, c := range ci.ctx {
+			cx := ctxSnapshot{Cwd: c.cwd, Exec: c.ec}
+			for _, e := range c.env {
+				if cx.Env == nil {
+					cx.Env = map[string]string{}
+				}
+				i := strings.IndexByte(e, '=')
+				cx.Env[e[:i]] = e[i+1:]
+			}
+			cs.Ctx = append(cs.Ctx, cx)
+		}
+		s.Cmds = append(s.Cmds, cs)
+	}
+	if sessionsOn {
+		for _, si := range sessInfos {
+			s.Sessions = append(s.Sessions, sessSnapshot{Sid: si.sid, Tty: ttyName(si.tty), Leader: si.leader, User: si.user, Exec: si.ec, Time: si.et})
+		}
+		sort.Slice(s.Sessions, func(i, j int) bool { return s.Sessions[i].Exec > s.Sessions[j].Exec })
+	}
+	for _, ni := range nsInfos {
+		ns := nsSnapshot{Ino: ni.ino, Host: ni.ino == selfNs.pidns, MntNs: ni.mntns, Init: ni.init, InitPid: ni.initPid, InitNs: ni.initNs, Exec: ni.ec, Time: ni.et, Cmds: map[string]uint64{}}
+		for c, n := range ni.cmds {
+			ns.Cmds[c] = n
+		}
+		s.Ns = append(s.Ns, ns)
+	}
+	sort.Slice(s.Ns, func(i, j int) bool { return s.Ns[i].Exec > s.Ns[j].Exec })
+	if treeOn {
+		t := makeTreeSnapshot(treeRoot)
+		s.Tree = &t
+	}
+	mutInfos.Unlock()
+	sort.Slice(s.Cmds, func(i, j int) bool {
+		a, b := &s.Cmds[i], &s.Cmds[j]
+		if a.Exec != b.Exec {
+			return a.Exec > b.Exec
+		}
+		return a.Cmd < b.Cmd
+	})
+	return s
+}
+
+// Exec rate of a command in a snapshot.
+func (s *snapshot) rate(n uint64) float64 {
+	if s.Duration == 0 {
+		return 0
+	}
+	return float64(n) / time.Duration(s.Duration).Seconds()
+}
+
+// Output the stats as a single line JSON snapshot.
+func statsJSON() {
+	b, err := json.Marshal(takeSnapshot())
+	if err != nil {
+		logf(prioErr, "%s", err)
+		return
+	}
+	out.Write(append(b, '\n'))
+}
+
+// Read the last snapshot of a file (json lines written with -f json or a single json document).
+func readSnapshot(fn string) (*snapshot, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var last *snapshot
+	d := json.NewDecoder(f)
+	for {
+		s := &snapshot{}
+		err := d.Decode(s)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		last = s
+	}
+	if last == nil {
+		return nil, fmt.Errorf("%s: no snapshot found", fn)
+	}
+	return last, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var statsdAddr string     // -statsd: host:port of the StatsD (UDP) server.
+var statsdPrefix string   // -statsd-prefix: prefix of the metric names.
+var statsdFormat string   // -statsd-format: statsd or dogstatsd.
+var statsdTags stringList // -statsd-tags: k:v tags, hostname and cgroup add the corresponding tags (dogstatsd).
+
+const statsdMaxPacket = 1432 // keep the datagrams under the usual MTU.
+
+// extraNeeds is the bitmask of the process attributes needed outside of the filters (eg: the statsd cgroup tag).
+var extraNeeds uint
+
+// The StatsD exporter.
+type statsdClient struct {
+	addr    string
+	conn    net.Conn
+	dog     bool
+	prefix  string
+	tags    []string // global tags.
+	cgroup  bool     // tag the commands with their cgroup.
+	last    map[*cmdInfo]histCmd
+	lexec   uint64
+	lfork   uint64
+	lexit   uint64
+	ldrop   uint64
+	lhist   [len(ehist)]uint64
+	buf     []byte
+	mut     sync.Mutex
+	nbError int
+}
+
+var statsd *statsdClient
+
+func init() {
+	atExit(func() {
+		if statsd != nil {
+			statsd.push() // The counters accumulated since the last tick.
+		}
+	})
+}
+
+// Create, change or remove the StatsD exporter (at startup and after a configuration reload).
+// Assumes the global maps are locked after a reload.
+func setStatsd() error {
+	extraNeeds &^= 1 << fkCgroup
+	if statsdAddr == "" {
+		if statsd != nil {
+			statsd.conn.Close()
+			statsd = nil
+		}
+		return nil
+	}
+	if interval == 0 {
+		return fmt.Errorf("The StatsD exporter pushes the metrics at every interval, -statsd needs -i.")
+	}
+	c := &statsdClient{addr: statsdAddr, prefix: statsdPrefix, last: map[*cmdInfo]histCmd{}}
+	switch statsdFormat {
+	case "statsd":
+	case "dogstatsd":
+		c.dog = true
+	default:
+		return fmt.Errorf("Unknown StatsD format '%s'. Use -statsd-format 'statsd' or 'dogstatsd'.", statsdFormat)
+	}
+	for _, t := range statsdTags {
+		switch t {
+		case "hostname":
+			hn, _ := os.Hostname()
+			c.tags = append(c.tags, "host:"+hn)
+		case "cgroup":
+			c.cgroup = true
+			extraNeeds |= 1 << fkCgroup
+		default:
+			c.tags = append(c.tags, t)
+		}
+	}
+	if len(c.tags) != 0 || c.cgroup {
+		if !c.dog {
+			return fmt.Errorf("The StatsD tags need -statsd-format dogstatsd.")
+		}
+	}
+	if statsd != nil && statsd.addr == c.addr {
+		// Keep the connection and the previous counters (no burst of deltas after a reload).
+		c.conn, c.last, c.lexec, c.lfork, c.lexit, c.ldrop, c.lhist = statsd.conn, statsd.last, statsd.lexec, statsd.lfork, statsd.lexit, statsd.ldrop, statsd.lhist
+	} else {
+		conn, err := net.Dial("udp", c.addr)
+		if err != nil {
+			return fmt.Errorf("statsd: %s", err)
+		}
+		c.conn = conn
+		if statsd != nil {
+			statsd.conn.Close()
+		}
+		// Start from the current counters.
+		c.last, c.lexec, c.lfork, c.lexit, c.ldrop, c.lhist = map[*cmdInfo]histCmd{}, nbExecEv, nbforkev, nbExitEv, nbDroppedEv, ehist
+		for _, ci := range cmdInfos {
+			c.last[ci] = histCmd{ec: ci.ec, et: ci.et, subec: ci.subec}
+		}
+	}
+	statsd = c
+	return nil
+}
+
+// Escape a name for a metric name or a tag value.
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Add a metric to the current datagram (sent when it is full).
+func (c *statsdClient) metric(name string, v uint64, typ string, tags ...string) {
+	l := fmt.Sprintf("%s%s:%d|%s", c.prefix, name, v, typ)
+	if c.dog {
+		tags = append(tags, c.tags...)
+		if len(tags) != 0 {
+			l += "|#" + strings.Join(tags, ",")
+		}
+	}
+	if len(c.buf) != 0 && len(c.buf)+1+len(l) > statsdMaxPacket {
+		c.flush()
+	}
+	if len(c.buf) != 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, l...)
+}
+
+func (c *statsdClient) flush() {
+	if len(c.buf) == 0 {
+		return
+	}
+	if _, err := c.conn.Write(c.buf); err != nil {
+		// Nobody listening (ICMP port unreachable), only report it once.
+		if c.nbError == 0 {
+			logf(prioWarning, "statsd: %s", err)
+		}
+		c.nbError++
+	}
+	c.buf = c.buf[:0]
+}
+
+// Counter change (the counters restart from 0 after a clear).
+func delta(cur, last uint64) uint64 {
+	if cur < last {
+		return cur
+	}
+	return cur - last
+}
+
+// Push the counters changes since the last push.
+func (c *statsdClient) push() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	mutInfos.Lock()
+	exec, fork, exit, drop := delta(nbExecEv, c.lexec), delta(nbforkev, c.lfork), delta(nbExitEv, c.lexit), delta(nbDroppedEv, c.ldrop)
+	c.lexec, c.lfork, c.lexit, c.ldrop = nbExecEv, nbforkev, nbExitEv, nbDroppedEv
+	var hist [len(ehist)]uint64
+	for l := range ehist {
+		hist[l] = delta(ehist[l], c.lhist[l])
+	}
+	c.lhist = ehist
+	ncmds, nprocs := len(cmdInfos), len(procInfos)
+	var ds []*cmdDelta
+	ds, c.last = cmdDeltas(c.last)
+	cgroups := map[*cmdInfo]string{}
+	if c.cgroup {
+		for _, d := range ds {
+			if d.ci.attrs != nil {
+				for _, cg := range d.ci.attrs.cgroup {
+					if cg != "" {
+						cgroups[d.ci] = cg
+						break
+					}
+				}
+			}
+		}
+	}
+	mutInfos.Unlock()
+	c.metric("exec", exec, "c")
+	var fwoe uint64
+	if fork > exec+drop {
+		fwoe = fork - exec - drop
+	}
+	c.metric("forks_without_exec", fwoe, "c")
+	c.metric("exit", exit, "c")
+	c.metric("filtered_out", drop, "c")
+	c.metric("commands", uint64(ncmds), "g")
+	c.metric("processes", uint64(nprocs), "g")
+	// Histogram summary: the number of processes per execution time bucket.
+	p := 1
+	for l := range hist {
+		p *= 10
+		if hist[l] == 0 {
+			continue
+		}
+		b := strings.Replace(time.Duration(p).String(), "µ", "u", 1)
+		if c.dog {
+			c.metric("exec_time.bucket", hist[l], "c", "lt:"+b)
+		} else {
+			c.metric("exec_time.lt_"+statsdName(b), hist[l], "c")
+		}
+	}
+	// Per command: only the top ones (by the sort criteria) to keep the number of metrics bounded.
+	key := func(d *cmdDelta) uint64 {
+		if sortCriteria == scTime {
+			return d.et
+		}
+		return d.ec
+	}
+	sort.Slice(ds, func(i, j int) bool { return key(ds[i]) > key(ds[j]) })
+	for i, d := range ds {
+		if i >= top {
+			break
+		}
+		cmd := statsdName(d.cmd)
+		if c.dog {
+			tags := []string{"cmd:" + cmd}
+			if cg, known := cgroups[d.ci]; known {
+				tags = append(tags, "cgroup:"+statsdName(cg))
+			}
+			c.metric("cmd.exec", d.ec, "c", tags...)
+			c.metric("cmd.time_ms", d.et/1000000, "c", tags...)
+			c.metric("cmd.sub_exec", d.subec, "c", tags...)
+			continue
+		}
+		cmd = strings.ReplaceAll(cmd, ".", "_") // Not a new level of the metrics hierarchy.
+		c.metric("cmd."+cmd+".exec", d.ec, "c")
+		c.metric("cmd."+cmd+".time_ms", d.et/1000000, "c")
+		c.metric("cmd."+cmd+".sub_exec", d.subec, "c")
+	}
+	c.flush()
+}
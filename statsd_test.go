@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"awk", "awk"},
+		{"kworker/0:1", "kworker/0_1"},
+		{"a|b@c#d,e f", "a_b_c_d_e_f"},
+		{"l1\nl2", "l1_l2"},
+	}
+	for _, tt := range tests {
+		if got := statsdName(tt.in); got != tt.want {
+			t.Errorf("statsdName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStatsdPush(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tests := []struct {
+		format string
+		tags   []string
+		want   []string
+	}{
+		{"statsd", nil, []string{
+			"t.exec:2|c", "t.forks_without_exec:1|c", "t.exit:0|c", "t.filtered_out:0|c", "t.commands:1|g", "t.processes:0|g",
+			"t.exec_time.lt_1ms:2|c",
+			"t.cmd.my_cmd.exec:2|c", "t.cmd.my_cmd.time_ms:3|c", "t.cmd.my_cmd.sub_exec:1|c",
+		}},
+		{"dogstatsd", []string{"env:test"}, []string{
+			"t.exec:2|c|#env:test", "t.forks_without_exec:1|c|#env:test", "t.exit:0|c|#env:test", "t.filtered_out:0|c|#env:test",
+			"t.commands:1|g|#env:test", "t.processes:0|g|#env:test",
+			"t.exec_time.bucket:2|c|#lt:1ms,env:test",
+			"t.cmd.exec:2|c|#cmd:my.cmd,env:test", "t.cmd.time_ms:3|c|#cmd:my.cmd,env:test", "t.cmd.sub_exec:1|c|#cmd:my.cmd,env:test",
+		}},
+	}
+	for _, tt := range tests {
+		cmdInfos, procInfos = map[string]*cmdInfo{}, map[int]*procInfo{}
+		nbExecEv, nbforkev, nbExitEv, nbDroppedEv, ehist = 0, 0, 0, 0, [len(ehist)]uint64{}
+		statsd = nil
+		statsdAddr, statsdPrefix, statsdFormat, statsdTags = l.LocalAddr().String(), "t.", tt.format, tt.tags
+		interval, top, sortCriteria = time.Second, 10, scCount
+		if err := setStatsd(); err != nil {
+			t.Fatalf("%s: %s", tt.format, err)
+		}
+		// Counted since the creation of the exporter.
+		cmdInfos["my.cmd"] = &cmdInfo{cmd: "my.cmd", ec: 2, et: 3000000, subec: 1}
+		nbExecEv, nbforkev = 2, 3
+		ehist[5] = 2
+		statsd.push()
+		l.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, statsdMaxPacket)
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.format, err)
+		}
+		if got, want := string(buf[:n]), strings.Join(tt.want, "\n"); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, got, want)
+		}
+		statsd.conn.Close()
+		statsd = nil
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var syslogTarget string // -syslog: journal, unix[:path] or udp:host:port.
+var syslogStorm float64 // -syslog-storm: exec/s rate of an exec storm alert (0: no alerts).
+
+const syslogFacility = 3          // daemon.
+const syslogSdID = "trexec@32473" // structured data id (32473 is the example enterprise number).
+const syslogMaxCmds = 5           // number of commands in a message.
+
+// The syslog / journal sink of the summaries.
+type syslogSink struct {
+	target  string
+	journal bool
+	network string // unixgram, unix or udp.
+	addr    string
+	conn    net.Conn
+	host    string
+	app     string
+	last    map[*cmdInfo]histCmd
+	lt      time.Time
+	lexec   uint64
+	lfork   uint64
+	lexit   uint64
+	ldrop   uint64
+	storm   bool // in an exec storm (the alert was sent).
+	closed  bool // replaced by a reload, a late push is dropped.
+	mut     sync.Mutex
+	nbError int
+}
+
+var syslogOut *syslogSink
+
+func init() {
+	atExit(func() {
+		if syslogOut != nil {
+			syslogOut.push()
+			syslogOut.close()
+		}
+	})
+}
+
+// Create, change or remove the syslog sink (at startup and after a configuration reload).
+// Called with the global maps unlocked.
+func setSyslog() error {
+	if syslogTarget == "" {
+		mutInfos.Lock()
+		old := syslogOut
+		syslogOut = nil
+		mutInfos.Unlock()
+		if old != nil {
+			old.close()
+		}
+		return nil
+	}
+	if interval == 0 {
+		return fmt.Errorf("The syslog summaries are sent at every interval, -syslog needs -i.")
+	}
+	if syslogStorm < 0 {
+		return fmt.Errorf("Invalid exec storm rate %g.", syslogStorm)
+	}
+	s := &syslogSink{target: syslogTarget, app: path.Base(os.Args[0])}
+	s.host, _ = os.Hostname()
+	kind, addr, _ := strings.Cut(syslogTarget, ":")
+	switch kind {
+	case "journal":
+		s.journal = true
+	case "unix":
+		s.network, s.addr = "unixgram", addr
+		if addr == "" {
+			s.addr = "/dev/log"
+		}
+	case "udp":
+		if addr == "" {
+			return fmt.Errorf("Missing syslog server address. Use -syslog udp:host:port.")
+		}
+		s.network, s.addr = "udp", addr
+	default:
+		return fmt.Errorf("Unknown syslog target '%s'. Use -syslog 'journal', 'unix[:path]' or 'udp:host:port'.", syslogTarget)
+	}
+	if syslogOut != nil && syslogOut.target == s.target {
+		return nil // Keep the connection and the previous counters.
+	}
+	if !s.journal {
+		if err := s.dial(); err != nil {
+			return fmt.Errorf("syslog: %s", err)
+		}
+	}
+	// Start from the current counters.
+	mutInfos.Lock()
+	s.last, s.lt, s.lexec, s.lfork, s.lexit, s.ldrop = map[*cmdInfo]histCmd{}, time.Now(), nbExecEv, nbforkev, nbExitEv, nbDroppedEv
+	for _, ci := range cmdInfos {
+		s.last[ci] = histCmd{ec: ci.ec, et: ci.et, subec: ci.subec}
+	}
+	old := syslogOut
+	syslogOut = s // Read by the tick loop under the global maps lock.
+	mutInfos.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// Connect to the syslog socket (datagram, else stream for the unix sockets).
+func (s *syslogSink) dial() error {
+	conn, err := net.Dial(s.network, s.addr)
+	if err != nil && s.network == "unixgram" {
+		if conn, err = net.Dial("unix", s.addr); err == nil {
+			s.network = "unix"
+		}
+	}
+	s.conn = conn
+	return err
+}
+
+func (s *syslogSink) close() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Escape a structured data parameter value.
+var syslogSdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// Send a message with its structured data (key, value pairs).
+// msgid is the kind of message (summary, storm), also sent as the TREXEC_EVENT journal field.
+func (s *syslogSink) send(prio int, msgid string, msg string, kvs ...string) {
+	if s.journal {
+		fields := map[string]string{
+			"MESSAGE":           msg,
+			"PRIORITY":          strconv.Itoa(prio),
+			"SYSLOG_IDENTIFIER": s.app,
+			"TREXEC_EVENT":      msgid,
+		}
+		for i := 0; i+1 < len(kvs); i += 2 {
+			fields["TREXEC_"+strings.ToUpper(kvs[i])] = kvs[i+1]
+		}
+		if err := journalSend(fields); err != nil {
+			s.error(err)
+		}
+		return
+	}
+	// RFC 5424: <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID k="v"...] MSG
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s", syslogFacility*8+prio, time.Now().Format(time.RFC3339Nano), s.host, s.app, os.Getpid(), msgid, syslogSdID)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		fmt.Fprintf(&b, ` %s="%s"`, kvs[i], syslogSdEscaper.Replace(kvs[i+1]))
+	}
+	b.WriteString("] ")
+	b.WriteString(msg)
+	if s.network == "unix" {
+		b.WriteByte('\n') // Stream: one message per line.
+	}
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			s.error(err)
+			return
+		}
+	}
+	if _, err := s.conn.Write([]byte(b.String())); err != nil {
+		s.error(err)
+		s.conn.Close()
+		s.conn = nil // Reconnect next time (syslog daemon restarted).
+	}
+}
+
+// Only report the first error of a series.
+func (s *syslogSink) error(err error) {
+	if s.nbError == 0 {
+		logf(prioWarning, "syslog: %s", err)
+	}
+	s.nbError++
+}
+
+// Send the summary of the counters changes since the last one, and the exec storm alerts.
+func (s *syslogSink) push() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed {
+		return
+	}
+	mutInfos.Lock()
+	exec, fork, exit, drop := delta(nbExecEv, s.lexec), delta(nbforkev, s.lfork), delta(nbExitEv, s.lexit), delta(nbDroppedEv, s.ldrop)
+	s.lexec, s.lfork, s.lexit, s.ldrop = nbExecEv, nbforkev, nbExitEv, nbDroppedEv
+	var ds []*cmdDelta
+	ds, s.last = cmdDeltas(s.last)
+	mutInfos.Unlock()
+	now := time.Now()
+	d := now.Sub(s.lt)
+	s.lt = now
+	var fwoe uint64
+	if fork > exec+drop {
+		fwoe = fork - exec - drop
+	}
+	rate := 0.0
+	if d > 0 {
+		rate = float64(exec) / d.Seconds()
+	}
+	key := func(d *cmdDelta) uint64 {
+		if sortCriteria == scTime {
+			return d.et
+		}
+		return d.ec
+	}
+	sort.Slice(ds, func(i, j int) bool { return key(ds[i]) > key(ds[j]) })
+	var tops []string
+	for i, d := range ds {
+		if i >= syslogMaxCmds {
+			break
+		}
+		tops = append(tops, fmt.Sprintf("%s:%d:%s", d.cmd, d.ec, time.Duration(d.et).Round(time.Millisecond)))
+	}
+	top := strings.Join(tops, " ")
+	msgTop := ""
+	if top != "" {
+		msgTop = " top: " + top
+	}
+	r := strconv.FormatFloat(rate, 'f', 2, 64)
+	s.send(prioInfo, "summary",
+		fmt.Sprintf("%d exec (%s/s), %d forks without exec, %d exit, %d filtered out in %s.%s", exec, r, fwoe, exit, drop, d.Round(time.Second), msgTop),
+		"exec", strconv.FormatUint(exec, 10), "exec_rate", r, "forks_without_exec", strconv.FormatUint(fwoe, 10),
+		"exit", strconv.FormatUint(exit, 10), "filtered_out", strconv.FormatUint(drop, 10),
+		"duration_s", strconv.FormatFloat(d.Seconds(), 'f', 0, 64), "top", top)
+	if syslogStorm == 0 {
+		return
+	}
+	switch {
+	case rate >= syslogStorm && !s.storm:
+		s.storm = true
+		s.send(prioWarning, "storm",
+			fmt.Sprintf("Exec storm: %s exec/s (threshold %g/s).%s", r, syslogStorm, msgTop),
+			"exec_rate", r, "threshold", strconv.FormatFloat(syslogStorm, 'f', -1, 64), "top", top)
+	case rate < syslogStorm && s.storm:
+		s.storm = false
+		s.send(prioNotice, "storm_end",
+			fmt.Sprintf("Exec storm over: %s exec/s (threshold %g/s).", r, syslogStorm),
+			"exec_rate", r, "threshold", strconv.FormatFloat(syslogStorm, 'f', -1, 64))
+	}
+}
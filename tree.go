@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var treeOn bool // -A: aggregate the exec() events by ancestry chain.
+
+const treeMaxNodes = 20000 // beyond, the new branches are accounted in a (truncated) node.
+
+// A node of the ancestry tree: a command under a given chain of ancestor commands.
+type treeNode struct {
+	cmd  string
+	ec   uint64 // exec() of this command under this chain.
+	et   uint64 // execution time of these processes.
+	cpu  uint64 // CPU time of these processes (-m).
+	kids map[string]*treeNode
+}
+
+var treeRoot = &treeNode{kids: map[string]*treeNode{}}
+var treeNodes int
+
+// Child node of a command, created if needed (unless the tree is full).
+// Assumes the global maps are locked.
+func (n *treeNode) kid(cmd string) *treeNode {
+	k, known := n.kids[cmd]
+	if known {
+		return k
+	}
+	if treeNodes >= treeMaxNodes {
+		cmd = "(truncated)"
+		if k, known = n.kids[cmd]; known {
+			return k
+		}
+	}
+	k = &treeNode{cmd: cmd, kids: map[string]*treeNode{}}
+	n.kids[cmd] = k
+	treeNodes++
+	return k
+}
+
+// Account an exec() in the tree. anc is the chain of the ancestor commands (parent first).
+// Assumes the global maps are locked.
+func recordTree(pi *procInfo, anc []string) {
+	n := treeRoot
+	for i := len(anc) - 1; i >= 0; i-- {
+		n = n.kid(anc[i])
+		if n.cmd == "(truncated)" {
+			break
+		}
+	}
+	if n.cmd != "(truncated)" {
+		cmd := pi.ci.cmd
+		if cmd == "" {
+			cmd = "(vanished)"
+		}
+		n = n.kid(cmd)
+	}
+	n.ec++
+	pi.tn = n
+}
+
+// Reset the tree (clear of the counters).
+func clearTree() {
+	treeRoot = &treeNode{kids: map[string]*treeNode{}}
+	treeNodes = 0
+}
+
+// Ancestry tree node in a snapshot (-A).
+type treeSnapshot struct {
+	Cmd     string         `json:"cmd"`
+	Exec    uint64         `json:"exec"`
+	Time    uint64         `json:"time_ns"`
+	CPU     uint64         `json:"cpu_ns,omitempty"` // -m
+	SubExec uint64         `json:"sub_exec"`         // exec() of the descendants.
+	SubTime uint64         `json:"sub_time_ns"`      // execution time of the descendants.
+	Kids    []treeSnapshot `json:"children,omitempty"`
+}
+
+// Snapshot of a node and its descendants, the children sorted by exec() count of their subtree.
+// Assumes the global maps are locked.
+func makeTreeSnapshot(n *treeNode) treeSnapshot {
+	s := treeSnapshot{Cmd: n.cmd, Exec: n.ec, Time: n.et, CPU: n.cpu}
+	for _, k := range n.kids {
+		ks := makeTreeSnapshot(k)
+		s.SubExec += ks.Exec + ks.SubExec
+		s.SubTime += ks.Time + ks.SubTime
+		s.Kids = append(s.Kids, ks)
+	}
+	sort.Slice(s.Kids, func(i, j int) bool {
+		a, b := &s.Kids[i], &s.Kids[j]
+		if a.Exec+a.SubExec != b.Exec+b.SubExec {
+			return a.Exec+a.SubExec > b.Exec+b.SubExec
+		}
+		return a.Cmd < b.Cmd
+	})
+	return s
+}
+
+// Display the ancestry tree: the branches with at least 1% of the exec() (at most top children per node).
+func statsTree(dts float64) {
+	mutInfos.Lock()
+	root := makeTreeSnapshot(treeRoot)
+	mutInfos.Unlock()
+	total := root.SubExec
+	if total == 0 {
+		return
+	}
+	printSep(out, " ancestry tree (branches with more than 1%% of the exec) ")
+	var walk func(n *treeSnapshot, path []string)
+	walk = func(n *treeSnapshot, path []string) {
+		for i := range n.Kids {
+			k := &n.Kids[i]
+			if i >= top || (k.Exec+k.SubExec)*100 < total {
+				break
+			}
+			p := append(path[:len(path):len(path)], k.Cmd)
+			if raw {
+				fmt.Fprintf(out, "at:%s:%d:%.2f:%s:%d:%s\n", strings.Join(p, "/"), k.Exec, float64(k.Exec)/dts, time.Duration(k.Time), k.SubExec, time.Duration(k.SubTime))
+			} else {
+				fmt.Fprintf(out, "%s%s: %d (%.2fe/s) %s", strings.Repeat("  ", len(path)), k.Cmd, k.Exec, float64(k.Exec)/dts, time.Duration(k.Time))
+				if k.SubExec != 0 {
+					fmt.Fprintf(out, " +%d below %s", k.SubExec, time.Duration(k.SubTime))
+				}
+				fmt.Fprintf(out, "\n")
+			}
+			walk(k, p)
+		}
+	}
+	walk(&root, nil)
+}
@@ -13,7 +13,7 @@ import (
 )
 
 // display a separator with an insert.
-func printSep(f *os.File, format string, a ...interface{}) {
+func printSep(f io.Writer, format string, a ...interface{}) {
 	w := int(wColNb) // Separator width will match terminal width.
 	lm := 5          // left margin
 	sc := "-"
@@ -195,6 +195,20 @@ func max64(a, b int64) int64 {
 	return b
 }
 
+func umax64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func umin64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func findNextIndex(s []byte, start int, char byte) int {
 	sl := len(s)
 	for ; start < sl; start++ {
@@ -241,3 +255,26 @@ var wColNb, wRowNb uint
 func init() {
 	wColNb, wRowNb = getTermDimensions()
 }
+
+// A list of strings, usable as a repeatable flag (comma separated values are split).
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+func (l *stringList) reset() {
+	*l = nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var httpAddr string // -http: address of the web dashboard and JSON API (eg: localhost:8080).
+
+const httpRefresh = 2 * time.Second // period of the dashboard updates (server-sent events).
+
+//go:embed web
+var webFiles embed.FS
+
+// The web server.
+type webServer struct {
+	addr    string
+	srv     *http.Server
+	samples apiSamples // for the time windows of the API.
+}
+
+var web *webServer
+
+func init() {
+	atExit(func() {
+		if web != nil {
+			web.close()
+		}
+	})
+}
+
+// Start, move or stop the web server (at startup and after a configuration reload).
+func setHTTP() error {
+	if web != nil && web.addr == httpAddr {
+		return nil
+	}
+	if web != nil {
+		web.close()
+		web = nil
+	}
+	if httpAddr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		return fmt.Errorf("http: %s", err)
+	}
+	ws := &webServer{addr: httpAddr, samples: apiSamples{done: make(chan bool)}}
+	ws.srv = &http.Server{Handler: ws.mux(), ReadHeaderTimeout: 10 * time.Second}
+	go ws.samples.run()
+	go func() {
+		if err := ws.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logf(prioErr, "http: %s", err)
+		}
+	}()
+	web = ws
+	return nil
+}
+
+// Stop the server, the dashboards streams included.
+func (ws *webServer) close() {
+	ws.srv.Close()
+	close(ws.samples.done)
+}
+
+// Routes of the web server.
+// (No method patterns: they are ignored without a go.mod, the handlers check the method.)
+func (ws *webServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	static, _ := fs.Sub(webFiles, "web")
+	mux.Handle("/", onlyMethod("GET", http.FileServerFS(static).ServeHTTP))
+	mux.HandleFunc("/api/dashboard", onlyMethod("GET", apiDashboard))
+	mux.HandleFunc("/api/stream", onlyMethod("GET", apiStream))
+	mux.HandleFunc("/api/reset", onlyMethod("POST", apiReset))
+	mux.HandleFunc("/api/snapshot", onlyMethod("GET", ws.apiSnapshot))
+	mux.HandleFunc("/api/commands", onlyMethod("GET", ws.apiCommands))
+	mux.HandleFunc("/api/commands/", onlyMethod("GET", ws.apiCommand))
+	mux.HandleFunc("/api/tree", onlyMethod("GET", ws.apiTree))
+	mux.HandleFunc("/api/histogram", onlyMethod("GET", ws.apiHistogram))
+	return mux
+}
+
+// Reject the requests with another method (HEAD is accepted for GET).
+func onlyMethod(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m && !(m == "GET" && r.Method == "HEAD") {
+			w.Header().Set("Allow", m)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Dashboard update: the header counters, the histogram and the top commands and subtrees.
+type dashboard struct {
+	Hostname string        `json:"hostname"`
+	Date     time.Time     `json:"date"`
+	Start    time.Time     `json:"start"`
+	Duration int64         `json:"duration_ns"`
+	Exec     uint64        `json:"exec"`
+	Forks    uint64        `json:"forks_without_exec"`
+	Exit     uint64        `json:"exit"`
+	Dropped  uint64        `json:"filtered_out"`
+	Cmds     int           `json:"commands"`
+	Sort     string        `json:"sort"`
+	Sorts    []string      `json:"sorts"` // available sort criteria.
+	Hist     []uint64      `json:"histogram"`
+	Top      []cmdSnapshot `json:"top"`
+	Subs     []cmdSnapshot `json:"subtrees"`
+}
+
+var sortKeys = [len(scStrings)]string{"count", "time", "rss", "faults", "io"}
+
+// Value of the sort criteria of a command (or of its subtree) in a snapshot.
+func snapshotKey(c *cmdSnapshot, sc int, sub bool) uint64 {
+	e, t, r := c.Exec, c.Time, c.Res
+	if sub {
+		if c.SubHide {
+			return 0
+		}
+		e, t, r = c.SubExec, c.SubTime, c.SubRes
+	}
+	switch sc {
+	case scCount:
+		return e
+	case scTime:
+		return t
+	}
+	if r == nil {
+		return 0
+	}
+	switch sc {
+	case scRSS:
+		return r.RSS
+	case scFaults:
+		return r.MinFlt + r.MajFlt
+	}
+	return r.Read + r.Write
+}
+
+// Top commands of a snapshot (or subtrees) by the current sort criteria.
+func topSnapshots(s *snapshot, sc int, sub bool, n int) []cmdSnapshot {
+	var cs []cmdSnapshot
+	for _, c := range s.Cmds {
+		if snapshotKey(&c, sc, sub) != 0 {
+			cs = append(cs, c)
+		}
+	}
+	sort.SliceStable(cs, func(i, j int) bool { return snapshotKey(&cs[i], sc, sub) > snapshotKey(&cs[j], sc, sub) })
+	if len(cs) > n {
+		cs = cs[:n]
+	}
+	return cs
+}
+
+// Number of lines of the top lists (top parameter, else -t).
+func queryTop(r *http.Request) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && n > 0 {
+		return n
+	}
+	return top
+}
+
+// Sort criteria of a request (sort parameter, else -s).
+func querySort(r *http.Request) (int, error) {
+	mutInfos.Lock() // Changed by a reload.
+	sc, mem := sortCriteria, memOn
+	mutInfos.Unlock()
+	k := r.URL.Query().Get("sort")
+	if k == "" {
+		return sc, nil
+	}
+	i := 0
+	for i < len(sortKeys) && sortKeys[i] != k {
+		i++
+	}
+	if i == len(sortKeys) {
+		return 0, fmt.Errorf("Unknown sort criteria '%s'. Use sort=count, time, rss, faults or io.", k)
+	}
+	if i > scTime && !mem {
+		return 0, fmt.Errorf("Sort criteria '%s' needs the memory and I/O sampling (-m).", k)
+	}
+	return i, nil
+}
+
+func makeDashboard(n, sc int) *dashboard {
+	s := takeSnapshot()
+	d := &dashboard{Hostname: s.Hostname, Date: s.Date, Start: s.Start, Duration: s.Duration, Exec: s.Exec, Forks: s.Forks, Exit: s.Exit, Dropped: s.Dropped,
+		Cmds: len(s.Cmds), Sort: sortKeys[sc], Sorts: []string{"count", "time"}, Hist: s.Hist}
+	if memOn {
+		d.Sorts = sortKeys[:]
+	}
+	for i := range s.Cmds {
+		s.Cmds[i].Args, s.Cmds[i].Ctx = nil, nil // Not displayed.
+	}
+	d.Top = topSnapshots(s, sc, false, n)
+	d.Subs = topSnapshots(s, sc, true, n)
+	return d
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET /api/dashboard?top=n&sort=count|time|rss|faults|io
+func apiDashboard(w http.ResponseWriter, r *http.Request) {
+	sc, err := querySort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, makeDashboard(queryTop(r), sc))
+}
+
+// GET /api/stream?top=n&sort=count|time|rss|faults|io: a dashboard update every httpRefresh (server-sent events).
+func apiStream(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	sc, err := querySort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	n := queryTop(r)
+	t := time.NewTicker(httpRefresh)
+	defer t.Stop()
+	for {
+		b, _ := json.Marshal(makeDashboard(n, sc))
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+			return
+		}
+		f.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// POST /api/reset: clear the counters (like SIGUSR2).
+// The JSON content type keeps the simple (cross-site) requests out.
+func apiReset(w http.ResponseWriter, r *http.Request) {
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		http.Error(w, "expecting Content-Type: application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	clearCounters()
+	logf(prioInfo, "Counters cleared by %s.", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,150 @@
+// trexec dashboard: follows /api/stream (or polls /api/dashboard when server-sent events are not available).
+"use strict";
+
+var last = null;      // previous update (for the current rates).
+var lastCmds = {};    // exec counts of the previous update per command (and subtree).
+var rates = [];       // exec rate history for the sparkline.
+var maxRates = 150;
+var source = null;
+var timer = null;     // polling without server-sent events.
+
+function $(id) { return document.getElementById(id); }
+
+function fmtDur(ns) {
+	if (ns >= 3600e9) return (ns / 3600e9).toFixed(1) + "h";
+	if (ns >= 60e9) return (ns / 60e9).toFixed(1) + "m";
+	if (ns >= 1e9) return (ns / 1e9).toFixed(2) + "s";
+	if (ns >= 1e6) return (ns / 1e6).toFixed(2) + "ms";
+	if (ns >= 1e3) return (ns / 1e3).toFixed(2) + "µs";
+	return ns + "ns";
+}
+
+function cell(tr, text) {
+	var td = document.createElement("td");
+	td.textContent = text;
+	tr.appendChild(td);
+}
+
+function fillTable(id, cmds, sub, dt) {
+	var tbody = $(id).tBodies[0];
+	tbody.textContent = "";
+	cmds.forEach(function(c) {
+		var n = sub ? c.sub_exec : c.exec;
+		var k = (sub ? "sub:" : "cmd:") + c.cmd;
+		var tr = document.createElement("tr");
+		cell(tr, c.cmd);
+		cell(tr, n);
+		var prev = lastCmds[k];
+		cell(tr, prev !== undefined && dt > 0 && n >= prev ? ((n - prev) / dt).toFixed(2) : "");
+		cell(tr, fmtDur(sub ? c.sub_time_ns : c.time_ns));
+		lastCmds[k] = n;
+		tbody.appendChild(tr);
+	});
+}
+
+function drawSpark() {
+	var max = Math.max.apply(null, rates.concat([1]));
+	var pts = rates.map(function(r, i) {
+		return (i * 600 / (maxRates - 1)).toFixed(1) + "," + (78 - r * 76 / max).toFixed(1);
+	});
+	$("spark").innerHTML = '<polyline points="' + pts.join(" ") + '"/>';
+}
+
+function drawHist(h) {
+	var el = $("hist"), total = 0, max = 1;
+	h.forEach(function(n) { total += n; max = Math.max(max, n); });
+	el.textContent = "";
+	var p = 1;
+	h.forEach(function(n) {
+		p *= 10;
+		var d = document.createElement("div");
+		var pct = document.createElement("span");
+		pct.textContent = n && total ? (100 * n / total).toFixed(1) + "%" : "";
+		var bar = document.createElement("div");
+		bar.className = "bar";
+		bar.style.height = (140 * n / max) + "px";
+		bar.title = n + " processes";
+		var l = document.createElement("span");
+		l.textContent = "<" + fmtDur(p);
+		d.appendChild(pct);
+		d.appendChild(bar);
+		d.appendChild(l);
+		el.appendChild(d);
+	});
+}
+
+function fillSorts(d) {
+	var sel = $("sort");
+	if (sel.options.length !== d.sorts.length) {
+		sel.textContent = "";
+		d.sorts.forEach(function(s) {
+			var o = document.createElement("option");
+			o.textContent = s;
+			sel.appendChild(o);
+		});
+	}
+	if (document.activeElement !== sel) sel.value = d.sort;
+}
+
+function update(d) {
+	var dt = 0;
+	if (last) {
+		dt = (new Date(d.date) - new Date(last.date)) / 1000;
+		if (d.exec < last.exec) lastCmds = {}; // Counters cleared.
+		else if (dt > 0) {
+			var r = (d.exec - last.exec) / dt;
+			$("rate").textContent = r.toFixed(2);
+			rates.push(r);
+			if (rates.length > maxRates) rates.shift();
+			drawSpark();
+		}
+	}
+	$("hostname").textContent = d.hostname;
+	$("exec").textContent = d.exec;
+	$("forks").textContent = d.forks_without_exec;
+	$("commands").textContent = d.commands;
+	$("since").textContent = fmtDur(d.duration_ns);
+	$("avg").textContent = d.duration_ns ? (d.exec * 1e9 / d.duration_ns).toFixed(2) : "-";
+	fillSorts(d);
+	fillTable("top-cmds", d.top || [], false, dt);
+	fillTable("top-subs", d.subtrees || [], true, dt);
+	drawHist(d.histogram || []);
+	$("status").textContent = "";
+	last = d;
+}
+
+// The sort criteria is per dashboard (the default is -s until one is chosen).
+function query() {
+	var q = "top=" + $("top").value, s = $("sort").value;
+	return s ? q + "&sort=" + encodeURIComponent(s) : q;
+}
+
+function poll() {
+	fetch("api/dashboard?" + query()).then(function(r) { return r.json(); }).then(update).catch(function(e) {
+		$("status").textContent = "disconnected";
+	});
+}
+
+function connect() {
+	if (source) source.close();
+	if (!window.EventSource) {
+		poll();
+		if (!timer) timer = setInterval(poll, 2000);
+		return;
+	}
+	source = new EventSource("api/stream?" + query());
+	source.onmessage = function(e) { update(JSON.parse(e.data)); };
+	source.onerror = function() { $("status").textContent = "disconnected"; };
+}
+
+$("top").addEventListener("change", connect);
+$("sort").addEventListener("change", connect);
+$("reset").addEventListener("click", function() {
+	if (!confirm("Clear all the counters?")) return;
+	fetch("api/reset", {method: "POST", headers: {"Content-Type": "application/json"}}).then(function() {
+		last = null;
+		lastCmds = {};
+		rates = [];
+	});
+});
+connect();